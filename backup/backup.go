@@ -0,0 +1,515 @@
+package backup
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"leveldb_go/crc"
+	"leveldb_go/db"
+	"leveldb_go/vfs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A backup directory holds
+//
+//	shared/  tables, named after their file number, checksum and size so that a table is
+//	         stored once no matter how many backups contain it
+//	private/<id>/  the manifest and CURRENT of each backup
+//	meta/<id>  the list of files making up each backup
+//
+// A backup refers to a table already in shared/ rather than copying it again when the
+// number, size and checksum all match. Numbers alone don't identify a table, a restored
+// database reuses the numbers its original went on to use, as may another database
+// backed up in the same directory.
+const (
+	sharedDir  = "shared"
+	privateDir = "private"
+	metaDir    = "meta"
+	tmpDir     = "tmp"
+)
+
+var NotFoundErr = errors.New("backup not found")
+
+type Opt struct {
+	// FS is the filesystem of the backup directory, vfs.Default if nil.
+	// It must be the filesystem of the databases being backed up
+	FS vfs.FS
+}
+
+// Engine stores successive backups of a database in a backup directory. Its methods may
+// be called concurrently, they run one at a time
+type Engine struct {
+	fs  vfs.FS
+	dir string
+
+	// mu keeps DeleteBackup from removing the shared tables of a backup being created
+	mu sync.Mutex
+}
+
+// BackupInfo describes a stored backup
+type BackupInfo struct {
+	ID        int
+	Timestamp time.Time
+	Size      int64
+	NumFiles  int
+}
+
+type backupFile struct {
+	name     string // name of the file in the database
+	path     string // path relative to the backup directory
+	size     int64
+	checksum uint32
+}
+
+type backupMeta struct {
+	timestamp time.Time
+	files     []backupFile
+}
+
+// Open opens the backup directory dirname, creating it if needed
+func Open(dirname string, opt Opt) (*Engine, error) {
+	fs := opt.FS
+	if fs == nil {
+		fs = vfs.Default
+	}
+	for _, d := range []string{sharedDir, privateDir, metaDir} {
+		err := fs.MkdirAll(filepath.Join(dirname, d), 0755)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &Engine{
+		fs:  fs,
+		dir: dirname,
+	}, nil
+}
+
+// CreateBackup takes a checkpoint of d and stores it as a new backup.
+// Tables already stored by an earlier backup are not copied again
+func (e *Engine) CreateBackup(d *db.DB) (BackupInfo, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	ids, err := e.backupIDs()
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	id := 1
+	if len(ids) > 0 {
+		id = ids[len(ids)-1] + 1
+	}
+
+	staging := filepath.Join(e.dir, tmpDir, strconv.Itoa(id))
+	err = e.removeAll(staging)
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	err = e.fs.MkdirAll(filepath.Dir(staging), 0755)
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	shared, err := e.sharedTables()
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	meta := backupMeta{timestamp: time.Now()}
+	err = d.CheckpointExcept(staging, func(fileNum int, filename string) (bool, error) {
+		// reading the table is cheaper than copying it, which linking may not avoid
+		size, checksum, err := e.checksumFile(filename)
+		if err != nil {
+			return false, err
+		}
+		f, ok := shared[sharedKey{fileNum, size, checksum}]
+		if ok {
+			meta.files = append(meta.files, f)
+		}
+		return ok, nil
+	})
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	defer e.removeAll(staging)
+
+	names, err := e.fs.List(staging)
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	private := filepath.Join(privateDir, strconv.Itoa(id))
+	err = e.fs.MkdirAll(filepath.Join(e.dir, private), 0755)
+	if err != nil {
+		return BackupInfo{}, err
+	}
+
+	for _, name := range names {
+		src := filepath.Join(staging, name)
+		size, checksum, err := e.checksumFile(src)
+		if err != nil {
+			return BackupInfo{}, err
+		}
+		f := backupFile{
+			name:     name,
+			path:     filepath.Join(private, name),
+			size:     size,
+			checksum: checksum,
+		}
+		if strings.HasSuffix(name, ".ldb") {
+			f.path = filepath.Join(sharedDir, fmt.Sprintf("%s_%08x_%d.ldb", strings.TrimSuffix(name, ".ldb"), checksum, size))
+		}
+		_, err = e.fs.Stat(filepath.Join(e.dir, f.path))
+		if os.IsNotExist(err) {
+			err = e.fs.Rename(src, filepath.Join(e.dir, f.path))
+		}
+		if err != nil {
+			return BackupInfo{}, err
+		}
+		meta.files = append(meta.files, f)
+	}
+
+	err = e.writeMeta(id, &meta)
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	return meta.info(id), nil
+}
+
+// ListBackups returns the stored backups, oldest first
+func (e *Engine) ListBackups() ([]BackupInfo, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	ids, err := e.backupIDs()
+	if err != nil {
+		return nil, err
+	}
+	var infos []BackupInfo
+	for _, id := range ids {
+		meta, err := e.readMeta(id)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, meta.info(id))
+	}
+	return infos, nil
+}
+
+// DeleteBackup removes a backup along with the shared tables no other backup refers to
+func (e *Engine) DeleteBackup(id int) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	meta, err := e.readMeta(id)
+	if err != nil {
+		return err
+	}
+	// once the meta file is gone the backup no longer exists, even if we crash halfway
+	err = e.fs.Remove(e.metaFilename(id))
+	if err != nil {
+		return err
+	}
+	for _, f := range meta.files {
+		if !strings.HasPrefix(f.path, sharedDir) {
+			e.fs.Remove(filepath.Join(e.dir, f.path))
+		}
+	}
+	e.fs.Remove(filepath.Join(e.dir, privateDir, strconv.Itoa(id)))
+	return e.collectShared()
+}
+
+// sharedKey identifies a table stored in shared/
+type sharedKey struct {
+	fileNum  int
+	size     int64
+	checksum uint32
+}
+
+// sharedTables returns the tables stored in shared/, which a backup can refer to without
+// copying them
+func (e *Engine) sharedTables() (map[sharedKey]backupFile, error) {
+	names, err := e.fs.List(filepath.Join(e.dir, sharedDir))
+	if err != nil {
+		return nil, err
+	}
+	tables := make(map[sharedKey]backupFile)
+	for _, name := range names {
+		// <number>_<checksum>_<size>.ldb
+		parts := strings.Split(strings.TrimSuffix(name, ".ldb"), "_")
+		if len(parts) != 3 {
+			continue
+		}
+		fileNum, err := strconv.Atoi(parts[0])
+		if err != nil {
+			continue
+		}
+		checksum, err := strconv.ParseUint(parts[1], 16, 32)
+		if err != nil {
+			continue
+		}
+		size, err := strconv.ParseInt(parts[2], 10, 64)
+		if err != nil {
+			continue
+		}
+		tables[sharedKey{fileNum, size, uint32(checksum)}] = backupFile{
+			name:     parts[0] + ".ldb",
+			path:     filepath.Join(sharedDir, name),
+			size:     size,
+			checksum: uint32(checksum),
+		}
+	}
+	return tables, nil
+}
+
+// collectShared removes shared tables that no backup refers to
+func (e *Engine) collectShared() error {
+	ids, err := e.backupIDs()
+	if err != nil {
+		return err
+	}
+	live := make(map[string]bool)
+	for _, id := range ids {
+		meta, err := e.readMeta(id)
+		if err != nil {
+			return err
+		}
+		for _, f := range meta.files {
+			live[f.path] = true
+		}
+	}
+	names, err := e.fs.List(filepath.Join(e.dir, sharedDir))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		path := filepath.Join(sharedDir, name)
+		if !live[path] {
+			err = e.fs.Remove(filepath.Join(e.dir, path))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// VerifyBackup checks the size and checksum of every file in the backup
+func (e *Engine) VerifyBackup(id int) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	meta, err := e.readMeta(id)
+	if err != nil {
+		return err
+	}
+	for _, f := range meta.files {
+		size, checksum, err := e.checksumFile(filepath.Join(e.dir, f.path))
+		if err != nil {
+			return err
+		}
+		if size != f.size || checksum != f.checksum {
+			return fmt.Errorf("corruption: %s expected size %d checksum %08x, got size %d checksum %08x",
+				f.path, f.size, f.checksum, size, checksum)
+		}
+	}
+	return nil
+}
+
+// RestoreToDir writes the database stored in a backup into dirname, which must not hold a database.
+// The restored database can be opened with db.Open
+func (e *Engine) RestoreToDir(id int, dirname string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	meta, err := e.readMeta(id)
+	if err != nil {
+		return err
+	}
+	_, err = e.fs.Stat(filepath.Join(dirname, "CURRENT"))
+	if err == nil {
+		return fmt.Errorf("a database already exists in %s", dirname)
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	err = e.fs.MkdirAll(dirname, 0755)
+	if err != nil {
+		return err
+	}
+
+	// CURRENT goes last so that an interrupted restore does not look like a database
+	files := append([]backupFile(nil), meta.files...)
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[j].name == "CURRENT" && files[i].name != "CURRENT"
+	})
+	for _, f := range files {
+		err = e.copyFile(filepath.Join(e.dir, f.path), filepath.Join(dirname, f.name))
+		if err != nil {
+			return err
+		}
+	}
+	return e.fs.SyncDir(dirname)
+}
+
+func (e *Engine) backupIDs() ([]int, error) {
+	names, err := e.fs.List(filepath.Join(e.dir, metaDir))
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	for _, name := range names {
+		id, err := strconv.Atoi(name)
+		if err == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+func (e *Engine) metaFilename(id int) string {
+	return filepath.Join(e.dir, metaDir, strconv.Itoa(id))
+}
+
+// writeMeta stores the meta file of a backup, which is a line holding the timestamp
+// followed by a line per file of the form name path size checksum
+func (e *Engine) writeMeta(id int, meta *backupMeta) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d\n", meta.timestamp.UnixNano())
+	for _, f := range meta.files {
+		fmt.Fprintf(&b, "%s %s %d %08x\n", f.name, filepath.ToSlash(f.path), f.size, f.checksum)
+	}
+
+	tmpName := e.metaFilename(id) + ".tmp"
+	w, err := e.fs.Create(tmpName)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write([]byte(b.String()))
+	if err == nil {
+		err = w.Sync()
+	}
+	if err != nil {
+		w.Close()
+		e.fs.Remove(tmpName)
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	err = e.fs.Rename(tmpName, e.metaFilename(id))
+	if err != nil {
+		return err
+	}
+	return e.fs.SyncDir(filepath.Join(e.dir, metaDir))
+}
+
+func (e *Engine) readMeta(id int) (*backupMeta, error) {
+	r, err := e.fs.Open(e.metaFilename(id))
+	if os.IsNotExist(err) {
+		return nil, NotFoundErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	corrupt := fmt.Errorf("corruption: invalid meta file for backup %d", id)
+	scanner := bufio.NewScanner(r)
+	if !scanner.Scan() {
+		return nil, corrupt
+	}
+	nanos, err := strconv.ParseInt(scanner.Text(), 10, 64)
+	if err != nil {
+		return nil, corrupt
+	}
+	meta := &backupMeta{timestamp: time.Unix(0, nanos)}
+	for scanner.Scan() {
+		var f backupFile
+		_, err = fmt.Sscanf(scanner.Text(), "%s %s %d %x", &f.name, &f.path, &f.size, &f.checksum)
+		if err != nil {
+			return nil, corrupt
+		}
+		f.path = filepath.FromSlash(f.path)
+		meta.files = append(meta.files, f)
+	}
+	if scanner.Err() != nil {
+		return nil, scanner.Err()
+	}
+	return meta, nil
+}
+
+func (m *backupMeta) info(id int) BackupInfo {
+	info := BackupInfo{
+		ID:        id,
+		Timestamp: m.timestamp,
+		NumFiles:  len(m.files),
+	}
+	for _, f := range m.files {
+		info.Size += f.size
+	}
+	return info
+}
+
+func (e *Engine) checksumFile(name string) (int64, uint32, error) {
+	r, err := e.fs.Open(name)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer r.Close()
+
+	var c crc.CRC
+	var size int64
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		c = c.Update(buf[:n])
+		size += int64(n)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	return size, c.Value(), nil
+}
+
+func (e *Engine) copyFile(src, dst string) error {
+	r, err := e.fs.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := e.fs.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	if err == nil {
+		err = w.Sync()
+	}
+	if err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// removeAll removes a directory of files
+func (e *Engine) removeAll(dirname string) error {
+	names, err := e.fs.List(dirname)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		err = e.fs.Remove(filepath.Join(dirname, name))
+		if err != nil {
+			return err
+		}
+	}
+	return e.fs.Remove(dirname)
+}
@@ -0,0 +1,233 @@
+package backup
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"leveldb_go/db"
+	"leveldb_go/vfs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	testdbPath     = "testdb/db"
+	testBackupPath = "testdb/backup"
+	testRestore    = "testdb/restore"
+)
+
+func clearDir() {
+	err := os.RemoveAll("testdb")
+	if err != nil {
+		panic("cannot clean dir")
+	}
+}
+
+func setRange(t *testing.T, d *db.DB, from, to int, prefix string) {
+	for i := from; i < to; i++ {
+		err := d.Set([]byte(fmt.Sprint("key", i)), []byte(fmt.Sprint(prefix, i)))
+		assert.Nil(t, err)
+	}
+}
+
+func checkRange(t *testing.T, d *db.DB, from, to int, prefix string) {
+	for i := from; i < to; i++ {
+		v, err := d.Get([]byte(fmt.Sprint("key", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprint(prefix, i), string(v))
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	clearDir()
+
+	d, err := db.Open(testdbPath, db.Opt{})
+	assert.Nil(t, err)
+	defer d.Close()
+	e, err := Open(testBackupPath, Opt{})
+	assert.Nil(t, err)
+
+	setRange(t, d, 0, 10, "value")
+	first, err := e.CreateBackup(d)
+	assert.Nil(t, err)
+	setRange(t, d, 10, 20, "value")
+	second, err := e.CreateBackup(d)
+	assert.Nil(t, err)
+
+	infos, err := e.ListBackups()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(infos))
+	assert.Equal(t, first.ID, infos[0].ID)
+	assert.Equal(t, second.ID, infos[1].ID)
+
+	// the tables of the first backup are shared with the second
+	shared, err := os.ReadDir(filepath.Join(testBackupPath, sharedDir))
+	assert.Nil(t, err)
+	assert.Equal(t, second.NumFiles-2, len(shared))
+
+	assert.Nil(t, e.VerifyBackup(first.ID))
+	assert.Nil(t, e.VerifyBackup(second.ID))
+
+	assert.Nil(t, e.RestoreToDir(first.ID, testRestore))
+	restored, err := db.Open(testRestore, db.Opt{})
+	assert.Nil(t, err)
+	checkRange(t, restored, 0, 10, "value")
+	_, err = restored.Get([]byte("key15"))
+	assert.NotNil(t, err)
+	restored.Close()
+	assert.NotNil(t, e.RestoreToDir(first.ID, testRestore))
+
+	assert.Nil(t, e.DeleteBackup(first.ID))
+	assert.Equal(t, NotFoundErr, e.VerifyBackup(first.ID))
+	infos, err = e.ListBackups()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(infos))
+
+	assert.Nil(t, os.RemoveAll(testRestore))
+	assert.Nil(t, e.RestoreToDir(second.ID, testRestore))
+	restored, err = db.Open(testRestore, db.Opt{})
+	assert.Nil(t, err)
+	checkRange(t, restored, 0, 20, "value")
+	restored.Close()
+}
+
+func TestBackupDeleteCollectsShared(t *testing.T) {
+	clearDir()
+
+	d, err := db.Open(testdbPath, db.Opt{})
+	assert.Nil(t, err)
+	defer d.Close()
+	e, err := Open(testBackupPath, Opt{})
+	assert.Nil(t, err)
+
+	setRange(t, d, 0, 5, "value")
+	info, err := e.CreateBackup(d)
+	assert.Nil(t, err)
+	assert.Nil(t, e.DeleteBackup(info.ID))
+
+	shared, err := os.ReadDir(filepath.Join(testBackupPath, sharedDir))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(shared))
+	private, err := os.ReadDir(filepath.Join(testBackupPath, privateDir))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(private))
+}
+
+func TestVerifyBackupCorruption(t *testing.T) {
+	clearDir()
+
+	d, err := db.Open(testdbPath, db.Opt{})
+	assert.Nil(t, err)
+	defer d.Close()
+	e, err := Open(testBackupPath, Opt{})
+	assert.Nil(t, err)
+
+	setRange(t, d, 0, 5, "value")
+	info, err := e.CreateBackup(d)
+	assert.Nil(t, err)
+
+	shared, err := os.ReadDir(filepath.Join(testBackupPath, sharedDir))
+	assert.Nil(t, err)
+	name := filepath.Join(testBackupPath, sharedDir, shared[0].Name())
+	data, err := os.ReadFile(name)
+	assert.Nil(t, err)
+	data[0] ^= 0xff
+	assert.Nil(t, os.WriteFile(name, data, 0644))
+
+	assert.NotNil(t, e.VerifyBackup(info.ID))
+}
+
+// copyCountingFS fails links, as across devices, and counts the tables created
+type copyCountingFS struct {
+	vfs.FS
+	copies int
+}
+
+func (fs *copyCountingFS) Link(oldname, newname string) error {
+	return os.ErrPermission
+}
+
+func (fs *copyCountingFS) Create(name string) (vfs.File, error) {
+	if strings.HasSuffix(name, ".ldb") && strings.HasPrefix(name, filepath.Join(testBackupPath, tmpDir)) {
+		fs.copies++
+	}
+	return fs.FS.Create(name)
+}
+
+func TestBackupCopiesOnlyNewTables(t *testing.T) {
+	clearDir()
+
+	fs := &copyCountingFS{FS: vfs.Default}
+	d, err := db.Open(testdbPath, db.Opt{FS: fs})
+	assert.Nil(t, err)
+	defer d.Close()
+	e, err := Open(testBackupPath, Opt{FS: fs})
+	assert.Nil(t, err)
+
+	setRange(t, d, 0, 10, "value")
+	_, err = e.CreateBackup(d)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, fs.copies)
+	shared, err := os.ReadDir(filepath.Join(testBackupPath, sharedDir))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(shared))
+
+	// only the table flushed by the second backup is copied
+	setRange(t, d, 10, 20, "value")
+	second, err := e.CreateBackup(d)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, fs.copies)
+	assert.Nil(t, e.VerifyBackup(second.ID))
+
+	assert.Nil(t, e.RestoreToDir(second.ID, testRestore))
+	restored, err := db.Open(testRestore, db.Opt{})
+	assert.Nil(t, err)
+	checkRange(t, restored, 0, 20, "value")
+	restored.Close()
+}
+
+func TestBackupReusedTableNumbers(t *testing.T) {
+	clearDir()
+
+	d, err := db.Open(testdbPath, db.Opt{})
+	assert.Nil(t, err)
+	e, err := Open(testBackupPath, Opt{})
+	assert.Nil(t, err)
+	setRange(t, d, 0, 10, "value")
+	first, err := e.CreateBackup(d)
+	assert.Nil(t, err)
+	d.Close()
+
+	// both restores of the first backup number their new tables alike, values of the same
+	// length give them the same size
+	var infos []BackupInfo
+	for i, prefix := range []string{"value", "other"} {
+		dir := fmt.Sprint(testRestore, i)
+		assert.Nil(t, e.RestoreToDir(first.ID, dir))
+		restored, err := db.Open(dir, db.Opt{})
+		assert.Nil(t, err)
+		setRange(t, restored, 10, 20, prefix)
+		info, err := e.CreateBackup(restored)
+		assert.Nil(t, err)
+		infos = append(infos, info)
+		restored.Close()
+	}
+
+	// the table of the second restore was stored rather than taken for the first one
+	shared, err := os.ReadDir(filepath.Join(testBackupPath, sharedDir))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(shared))
+	assert.Equal(t, 4, infos[1].NumFiles)
+
+	for i, prefix := range []string{"value", "other"} {
+		assert.Nil(t, e.VerifyBackup(infos[i].ID))
+		dir := fmt.Sprint(testRestore, "-backup", infos[i].ID)
+		assert.Nil(t, e.RestoreToDir(infos[i].ID, dir))
+		restored, err := db.Open(dir, db.Opt{})
+		assert.Nil(t, err)
+		checkRange(t, restored, 0, 10, "value")
+		checkRange(t, restored, 10, 20, prefix)
+		restored.Close()
+	}
+}
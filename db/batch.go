@@ -0,0 +1,113 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"leveldb_go/util"
+	"time"
+)
+
+// batch is the unit written to the log. The layout follows leveldb:
+// an 8 byte sequence number and a 4 byte count, followed by count records of
+// the form type | uvarint keyLen | key | uvarint valueLen | value.
+// Deletions have no value, the value of a range deletion is the end of the range.
+// Records are assigned consecutive sequence numbers starting at seq.
+const batchHeaderLen = 12
+
+var batchCorruptErr = errors.New("corruption: invalid batch")
+
+type batch struct {
+	data []byte
+}
+
+func newBatch() *batch {
+	return &batch{
+		data: make([]byte, batchHeaderLen),
+	}
+}
+
+func (b *batch) set(key, value []byte) {
+	b.add(util.IKeyTypeSet, key, value)
+}
+
+func (b *batch) setWithExpiry(key, value []byte, expiry time.Time) {
+	b.add(util.IKeyTypeSetWithTTL, key, expiringValue(value, expiry))
+}
+
+func (b *batch) merge(key, operand []byte) {
+	b.add(util.IKeyTypeMerge, key, operand)
+}
+
+func (b *batch) deleteRange(start, end []byte) {
+	b.add(util.IKeyTypeRangeDelete, start, end)
+}
+
+func (b *batch) add(t util.IKeyType, key, value []byte) {
+	b.data = append(b.data, byte(t))
+	b.data = binary.AppendUvarint(b.data, uint64(len(key)))
+	b.data = append(b.data, key...)
+	b.data = binary.AppendUvarint(b.data, uint64(len(value)))
+	b.data = append(b.data, value...)
+	b.setCount(b.count() + 1)
+}
+
+// append adds the records of other, they take the sequence numbers following those of b
+func (b *batch) append(other *batch) {
+	b.data = append(b.data, other.data[batchHeaderLen:]...)
+	b.setCount(b.count() + other.count())
+}
+
+func (b *batch) seq() uint64 {
+	return binary.LittleEndian.Uint64(b.data)
+}
+
+func (b *batch) setSeq(seq uint64) {
+	binary.LittleEndian.PutUint64(b.data, seq)
+}
+
+func (b *batch) count() uint32 {
+	return binary.LittleEndian.Uint32(b.data[8:])
+}
+
+func (b *batch) setCount(n uint32) {
+	binary.LittleEndian.PutUint32(b.data[8:], n)
+}
+
+// forEach calls fn with the internal key of every record in the batch
+func (b *batch) forEach(fn func(ikey util.IKey, value []byte)) error {
+	if len(b.data) < batchHeaderLen {
+		return batchCorruptErr
+	}
+	seq := b.seq()
+	data := b.data[batchHeaderLen:]
+	for i := uint32(0); i < b.count(); i++ {
+		if len(data) == 0 {
+			return batchCorruptErr
+		}
+		t := util.IKeyType(data[0])
+		data = data[1:]
+		key, n := readLengthPrefixed(data)
+		if n == 0 {
+			return batchCorruptErr
+		}
+		data = data[n:]
+		var value []byte
+		if t != util.IKeyTypeDelete {
+			value, n = readLengthPrefixed(data)
+			if n == 0 {
+				return batchCorruptErr
+			}
+			data = data[n:]
+		}
+		fn(util.CreateIKey(key, t, seq+uint64(i)), value)
+	}
+	return nil
+}
+
+func readLengthPrefixed(data []byte) ([]byte, int) {
+	l, n := binary.Uvarint(data)
+	if n <= 0 || uint64(len(data)-n) < l {
+		return nil, 0
+	}
+	return data[n : n+int(l)], n + int(l)
+}
@@ -0,0 +1,92 @@
+package db
+
+import (
+	"bytes"
+	"leveldb_go/table"
+	"leveldb_go/util"
+	"leveldb_go/vfs"
+)
+
+// buildTable writes the contents of mem, range tombstones included, into a new level 0
+// table and returns its metadata. filter, if not nil, is applied to the newest value of
+// every key, the older entries it shadows are dropped. No table is written if nothing is
+// left, the returned metadata has no keys then
+func buildTable(fs vfs.FS, dirname string, fileNum int, mem *memTable, cmp util.Comparator, c table.Compressor, filter entryFilter) (tableFile, error) {
+	f, err := fs.Create(dbFilename(dirname, fileTypeTable, fileNum))
+	if err != nil {
+		return tableFile{}, err
+	}
+	defer f.Close()
+	writer := table.NewWriter(f, table.TableMaxBlockSize, cmp)
+	writer.SetCompressor(c)
+
+	var minKey, maxKey util.IKey
+	var lastSeq uint64
+	var userKey []byte
+	shadowed := false
+	it := mem.NewIterator()
+	for i := 0; it.Next() == nil; i++ {
+		key, value := util.IKey(it.Key()), it.Value()
+		if filter != nil {
+			if i == 0 || !bytes.Equal(key.Key(), userKey) {
+				userKey = append(userKey[:0], key.Key()...)
+				// merge operands and deletions are written as is
+				shadowed = key.KeyType() == util.IKeyTypeSet || key.KeyType() == util.IKeyTypeSetWithTTL
+				if shadowed {
+					var ok bool
+					key, value, ok = filter(key, value)
+					if !ok {
+						continue
+					}
+				}
+			} else if shadowed {
+				continue
+			}
+		}
+
+		if minKey == nil {
+			minKey = key
+		}
+		maxKey = key
+		if key.SeqNum() > lastSeq {
+			lastSeq = key.SeqNum()
+		}
+
+		err = writer.Add(key, value)
+		if err != nil {
+			return tableFile{}, err
+		}
+	}
+
+	tombstones := append([]rangeTombstone{}, mem.rangeTombstones()...)
+	sortTombstones(cmp, tombstones)
+	for _, t := range tombstones {
+		writer.AddRangeDel(t.ikey(), t.end)
+		minKey, maxKey = extendBounds(cmp, minKey, maxKey, t)
+		if t.seq > lastSeq {
+			lastSeq = t.seq
+		}
+	}
+	if minKey == nil {
+		f.Close()
+		return tableFile{}, fs.Remove(dbFilename(dirname, fileTypeTable, fileNum))
+	}
+	err = writer.Close()
+	if err != nil {
+		return tableFile{}, err
+	}
+	// the table must be durable before a manifest edit refers to it
+	err = f.Sync()
+	if err != nil {
+		return tableFile{}, err
+	}
+
+	return tableFile{
+		fileNum: fileNum,
+		minKey:  minKey,
+		maxKey:  maxKey,
+		level:   0,
+		size:    writer.Len(),
+		lastSeq: lastSeq,
+	}, nil
+}
@@ -0,0 +1,117 @@
+package db
+
+import (
+	"errors"
+	"io"
+	"leveldb_go/vfs"
+	"os"
+)
+
+// Checkpoint creates a consistent copy of the database in destDir, which must not exist yet.
+// The memtable is flushed first, then the live tables are hard linked into destDir, or copied
+// when linking fails, for example across devices. The manifest is copied up to its end at the
+// time of the flush, which is the state the links are taken from. Reads, writes and
+// compactions go on while the files are linked or copied.
+// The result can be opened on its own with Open.
+func (db *DB) Checkpoint(destDir string) error {
+	return db.CheckpointExcept(destDir, nil)
+}
+
+// CheckpointExcept is Checkpoint leaving out the tables for which skip returns true, e.g.
+// because an earlier backup holds them already. skip is called with the number and the
+// path of every live table, which it may read, table files are never modified once written
+func (db *DB) CheckpointExcept(destDir string, skip func(fileNum int, filename string) (bool, error)) error {
+	var src *checkpointSource
+	err := db.exclusive(func() error {
+		var err error
+		src, err = db.startCheckpoint(destDir)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	defer db.unrefVersion(src.version)
+	defer src.manifest.Close()
+
+	err = db.fs.MkdirAll(destDir, 0755)
+	if err != nil {
+		return err
+	}
+	for _, files := range src.version.files {
+		for _, f := range files {
+			name := dbFilename(db.dirname, fileTypeTable, f.fileNum)
+			if skip != nil {
+				skipped, err := skip(f.fileNum, name)
+				if err != nil {
+					return err
+				}
+				if skipped {
+					continue
+				}
+			}
+			err = linkOrCopyFile(db.fs, name, dbFilename(destDir, fileTypeTable, f.fileNum))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	// edits are synced as they are appended, so the size taken ends on a complete edit
+	err = writeFile(db.fs, dbFilename(destDir, fileTypeManifest, src.manifestNum), io.LimitReader(src.manifest, src.manifestSize))
+	if err != nil {
+		return err
+	}
+	return writeCurrentFile(db.fs, destDir, src.manifestNum)
+}
+
+// checkpointSource is the state a checkpoint copies, taken while db.mu is held
+type checkpointSource struct {
+	version      *Version
+	manifestNum  int
+	manifest     vfs.File
+	manifestSize int64
+}
+
+// startCheckpoint flushes the memtable and pins the version a checkpoint copies. The
+// manifest is opened right away, as Resume may replace it during the copy. db.mu must be held
+func (db *DB) startCheckpoint(destDir string) (*checkpointSource, error) {
+	if db.inMemory {
+		return nil, errors.New("in-memory databases are saved with SaveTo")
+	}
+	if db.readOnly {
+		return nil, ReadOnlyErr
+	}
+	_, err := db.fs.Stat(destDir)
+	if err == nil {
+		return nil, &os.PathError{Op: "checkpoint", Path: destDir, Err: os.ErrExist}
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	err = db.flushMemTable()
+	if err != nil {
+		return nil, err
+	}
+	src := &checkpointSource{manifestNum: db.manifest.fileNum}
+	src.manifest, err = db.fs.Open(dbFilename(db.dirname, fileTypeManifest, src.manifestNum))
+	if err != nil {
+		return nil, err
+	}
+	stat, err := src.manifest.Stat()
+	if err != nil {
+		src.manifest.Close()
+		return nil, err
+	}
+	src.manifestSize = stat.Size()
+	// compactions keep the tables of a pinned version
+	src.version = db.refVersion()
+	return src, nil
+}
+
+func linkOrCopyFile(fs vfs.FS, src, dst string) error {
+	err := fs.Link(src, dst)
+	if err == nil {
+		return nil
+	}
+	return copyFile(fs, src, fs, dst)
+}
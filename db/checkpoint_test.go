@@ -0,0 +1,106 @@
+package db
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"leveldb_go/vfs"
+	"os"
+	"sync"
+	"testing"
+)
+
+const checkpointPath = "testdb/checkpoint"
+
+func TestCheckpoint(t *testing.T) {
+	clearDir()
+	os.RemoveAll(checkpointPath)
+
+	db, err := Open(testdbPath, Opt{maxMemorySize: 300})
+	assert.Nil(t, err)
+	defer db.Close()
+	for i := 0; i < 100; i++ {
+		db.Set([]byte(fmt.Sprint("key", i)), []byte(fmt.Sprint("value", i)))
+	}
+
+	assert.Nil(t, db.Checkpoint(checkpointPath))
+	db.Set([]byte("key0"), []byte("changed"))
+	db.Set([]byte("after"), []byte("checkpoint"))
+
+	cp, err := Open(checkpointPath, opt)
+	assert.Nil(t, err)
+	defer cp.Close()
+	for i := 0; i < 100; i++ {
+		v, err := cp.Get([]byte(fmt.Sprint("key", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprint("value", i), string(v))
+	}
+	_, err = cp.Get([]byte("after"))
+	assert.NotNil(t, err)
+
+	// the checkpoint is independent of the original
+	cp.Set([]byte("key1"), []byte("checkpoint only"))
+	v, err := db.Get([]byte("key1"))
+	assert.Nil(t, err)
+	assert.Equal(t, "value1", string(v))
+	v, err = db.Get([]byte("key0"))
+	assert.Nil(t, err)
+	assert.Equal(t, "changed", string(v))
+
+	assert.NotNil(t, db.Checkpoint(checkpointPath))
+}
+
+// blockingLinkFS fails links, so that tables are copied, after waiting for release
+type blockingLinkFS struct {
+	vfs.FS
+	once    sync.Once
+	started chan struct{}
+	release chan struct{}
+}
+
+func (fs *blockingLinkFS) Link(oldname, newname string) error {
+	fs.once.Do(func() {
+		close(fs.started)
+		<-fs.release
+	})
+	return os.ErrPermission
+}
+
+func TestCheckpointDoesNotBlockDatabase(t *testing.T) {
+	clearDir()
+	fs := &blockingLinkFS{FS: vfs.NewMem(), started: make(chan struct{}), release: make(chan struct{})}
+	db, err := Open(testdbPath, Opt{maxMemorySize: 300, FS: fs, L0CompactionTrigger: 2})
+	assert.Nil(t, err)
+	defer db.Close()
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Set([]byte(fmt.Sprint("key", i)), []byte(fmt.Sprint("value", i))))
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- db.Checkpoint(checkpointPath)
+	}()
+	<-fs.started
+	// writes, reads and compactions go on while the tables are copied
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Set([]byte(fmt.Sprint("key", i)), []byte("changed")))
+	}
+	v, err := db.Get([]byte("key0"))
+	assert.Nil(t, err)
+	assert.Equal(t, "changed", string(v))
+	db.mu.Lock()
+	assert.Nil(t, db.flushMemTable())
+	assert.Nil(t, db.waitForCompactions())
+	db.mu.Unlock()
+	assert.True(t, db.Stats().Compactions > 0)
+	close(fs.release)
+	assert.Nil(t, <-done)
+
+	cp, err := Open(checkpointPath, Opt{FS: fs})
+	assert.Nil(t, err)
+	defer cp.Close()
+	for i := 0; i < 100; i++ {
+		v, err := cp.Get([]byte(fmt.Sprint("key", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprint("value", i), string(v))
+	}
+}
@@ -0,0 +1,194 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"leveldb_go/vfs"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCloseTwice(t *testing.T) {
+	clearDir()
+
+	db, err := Open(testdbPath, opt)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Set([]byte("key"), []byte("value")))
+	assert.Nil(t, db.Close())
+	assert.Nil(t, db.Close())
+
+	_, err = db.Get([]byte("key"))
+	assert.Equal(t, ErrClosed, err)
+	assert.Equal(t, ErrClosed, db.Set([]byte("key"), []byte("value")))
+	assert.Equal(t, ErrClosed, db.Checkpoint("testdb/checkpoint"))
+	assert.Equal(t, ErrClosed, db.Resume())
+}
+
+func TestCloseWaitsForReads(t *testing.T) {
+	clearDir()
+
+	mmapOpt := opt
+	mmapOpt.MmapBytes = 1 << 20
+	db, err := Open(testdbPath, mmapOpt)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Set([]byte(fmt.Sprint("key", i)), []byte(fmt.Sprint("value", i))))
+	}
+
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i = (i + 1) % 100 {
+				v, err := db.Get([]byte(fmt.Sprint("key", i)))
+				if err == ErrClosed {
+					return
+				}
+				assert.Nil(t, err)
+				assert.Equal(t, fmt.Sprint("value", i), string(v))
+			}
+		}()
+	}
+	assert.Nil(t, db.Close())
+	wg.Wait()
+}
+
+func TestCloseReportsErrors(t *testing.T) {
+	fs := vfs.NewFault(vfs.NewMem())
+	db, err := Open(testdbPath, Opt{FS: fs})
+	assert.Nil(t, err)
+	assert.Nil(t, db.Set([]byte("key"), []byte("value")))
+
+	// the flush can't sync its table
+	fs.InjectFault(vfs.OpSync, 0, false)
+	assert.NotNil(t, db.Close())
+	fs.ClearFaults()
+
+	db, err = Open(testdbPath, Opt{FS: fs})
+	assert.Nil(t, err)
+	defer db.Close()
+	v, err := db.Get([]byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, "value", string(v))
+}
+
+func TestCloseContextAbortsCompactions(t *testing.T) {
+	keys := writeLevel0(t, 3)
+
+	db, err := Open(testdbPath, withoutCompaction(opt))
+	assert.Nil(t, err)
+	tables := db.Stats().LevelFiles[0]
+	db.mu.Lock()
+	db.abortCompactions.Store(true)
+	err = db.compactLevel0()
+	db.abortCompactions.Store(false)
+	db.mu.Unlock()
+	assert.Equal(t, compactionAbortedErr, err)
+	assert.Equal(t, tables, db.Stats().LevelFiles[0])
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, db.CloseContext(ctx))
+
+	// nothing was lost
+	db, err = Open(testdbPath, withoutCompaction(opt))
+	assert.Nil(t, err)
+	defer db.Close()
+	assert.Equal(t, tables, db.Stats().LevelFiles[0])
+	for i := 0; i < keys; i++ {
+		v, err := db.Get([]byte(fmt.Sprint("key", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, "value value value value", string(v))
+	}
+}
+
+func TestCloseContextDoesNotWaitForReads(t *testing.T) {
+	clearDir()
+
+	db, err := Open(testdbPath, opt)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Set([]byte("key"), []byte("value")))
+	// a read that takes longer than the deadline
+	db.mu.Lock()
+	version := db.refVersion()
+	db.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	assert.Equal(t, context.DeadlineExceeded, db.CloseContext(ctx))
+	assert.True(t, time.Since(start) < time.Second)
+	// the files stay open for the read
+	_, err = Open(testdbPath, opt)
+	assert.Equal(t, LockErr, err)
+
+	db.unrefVersion(version)
+	db, err = Open(testdbPath, opt)
+	assert.Nil(t, err)
+	defer db.Close()
+	v, err := db.Get([]byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, "value", string(v))
+}
+
+func TestCloseContextDoesNotWaitForFlush(t *testing.T) {
+	fs := &blockingSyncFS{FS: vfs.NewMem(), release: make(chan struct{})}
+	db, err := Open(testdbPath, Opt{FS: fs})
+	assert.Nil(t, err)
+	assert.Nil(t, db.Set([]byte("key"), []byte("value")))
+
+	// the flush hangs syncing its table
+	fs.block.Store(true)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, db.CloseContext(ctx))
+	_, err = Open(testdbPath, Opt{FS: fs})
+	assert.Equal(t, LockErr, err)
+	close(fs.release)
+
+	// the flush completes and releases the database
+	for {
+		db, err = Open(testdbPath, Opt{FS: fs})
+		if err != LockErr {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	assert.Nil(t, err)
+	defer db.Close()
+	v, err := db.Get([]byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, "value", string(v))
+}
+
+// blockingSyncFS blocks the syncs of tables once block is set, until release is closed
+type blockingSyncFS struct {
+	vfs.FS
+	block   atomic.Bool
+	release chan struct{}
+}
+
+func (fs *blockingSyncFS) Create(name string) (vfs.File, error) {
+	f, err := fs.FS.Create(name)
+	if err != nil || !strings.HasSuffix(name, ".ldb") {
+		return f, err
+	}
+	return &blockingSyncFile{File: f, fs: fs}, nil
+}
+
+type blockingSyncFile struct {
+	vfs.File
+	fs *blockingSyncFS
+}
+
+func (f *blockingSyncFile) Sync() error {
+	if f.fs.block.Load() {
+		<-f.fs.release
+	}
+	return f.File.Sync()
+}
@@ -0,0 +1,646 @@
+package db
+
+import (
+	"container/heap"
+	"errors"
+	"leveldb_go/table"
+	"leveldb_go/util"
+	"leveldb_go/vfs"
+)
+
+// compactionAbortedErr stops a compaction when CloseContext runs out of time
+var compactionAbortedErr = errors.New("compaction aborted")
+
+const (
+	defaultL0CompactionTrigger     = 4
+	defaultL0SlowdownWritesTrigger = 8
+	defaultL0StopWritesTrigger     = 12
+
+	// compactions start a new table once the current one reaches this size
+	targetFileSize = 2 << 20
+)
+
+func (o Opt) l0CompactionTrigger() int {
+	if o.L0CompactionTrigger == 0 {
+		return defaultL0CompactionTrigger
+	}
+	return o.L0CompactionTrigger
+}
+
+func (o Opt) l0SlowdownWritesTrigger() int {
+	if o.L0SlowdownWritesTrigger == 0 {
+		return defaultL0SlowdownWritesTrigger
+	}
+	return o.L0SlowdownWritesTrigger
+}
+
+func (o Opt) l0StopWritesTrigger() int {
+	if o.L0StopWritesTrigger == 0 {
+		return defaultL0StopWritesTrigger
+	}
+	return o.L0StopWritesTrigger
+}
+
+// maybeScheduleCompaction starts the background goroutine if there is a memtable to
+// flush or level 0 needs compacting. Only one runs at a time. db.mu must be held
+func (db *DB) maybeScheduleCompaction() {
+	if db.bgScheduled || db.bgStopped || db.bgErr != nil || db.readOnly {
+		return
+	}
+	if db.imm == nil && (!db.needsCompaction() || db.abortCompactions.Load()) {
+		return
+	}
+	db.bgScheduled = true
+	go db.backgroundCall()
+}
+
+func (db *DB) needsCompaction() bool {
+	l0 := len(db.versionSet.currentVersion.files[0])
+	// writes stopped at the hard limit wait for a compaction, whatever the trigger is
+	return l0 >= db.opt.l0CompactionTrigger() || l0 >= db.opt.l0StopWritesTrigger()
+}
+
+func (db *DB) backgroundCall() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if !db.bgStopped && db.bgErr == nil {
+		err := db.backgroundCompaction()
+		if err != nil && err != compactionAbortedErr {
+			db.bgErr = newBackgroundError(err)
+		}
+	}
+	db.bgScheduled = false
+	// the compaction may have left level 0 past the trigger
+	db.maybeScheduleCompaction()
+	db.bgCond.Broadcast()
+	db.maybeFinishClose()
+}
+
+// backgroundCompaction flushes the immutable memtable first, as writes may be waiting
+// for it, then compacts level 0. db.mu must be held
+func (db *DB) backgroundCompaction() error {
+	if db.imm != nil {
+		return db.compactMemTable()
+	}
+	if db.needsCompaction() && !db.abortCompactions.Load() {
+		return db.compactLevel0()
+	}
+	return nil
+}
+
+// waitForCompactions waits until no background work is running. db.mu must be held
+func (db *DB) waitForCompactions() error {
+	for db.bgScheduled && db.bgErr == nil {
+		db.bgCond.Wait()
+	}
+	return db.bgErr
+}
+
+// compactMemTable writes db.imm into a level 0 table and removes its log.
+// db.mu must be held, it is released while the table is written
+func (db *DB) compactMemTable() error {
+	imm := db.imm
+	version := db.versionSet.currentVersion
+	fileNum := db.versionSet.newFileNum()
+	db.mu.Unlock()
+	meta, err := buildTable(db.fs, db.dirname, fileNum, imm, db.cmp, db.opt.compressor(0), db.flushFilter(version, imm))
+	db.mu.Lock()
+	if err != nil {
+		db.fs.Remove(dbFilename(db.dirname, fileTypeTable, fileNum))
+		return err
+	}
+
+	var files []tableFile
+	if meta.minKey != nil {
+		files = append(files, meta)
+	}
+	ve := NewVersionEdit(db.seqNum, files, nil)
+	if !db.inMemory {
+		// the entries of older logs are all in tables now
+		ve.logNum = db.logNum
+	}
+	err = db.logAndApply(ve)
+	if err != nil {
+		// the edit may have reached the manifest, Resume removes the table if it didn't
+		return err
+	}
+	db.imm = nil
+	if !db.inMemory {
+		db.fs.Remove(dbFilename(db.dirname, fileTypeLog, db.immLogNum))
+	}
+	db.stats.Flushes++
+	return nil
+}
+
+// compactLevel0 merges every level 0 table with the level 1 tables they overlap into new
+// level 1 tables. db.mu must be held, it is released while the tables are written
+func (db *DB) compactLevel0() error {
+	version := db.versionSet.currentVersion
+	inputs := append([]tableFile{}, version.files[0]...)
+	minKey, maxKey := inputs[0].minKey.Key(), inputs[0].maxKey.Key()
+	for _, f := range inputs[1:] {
+		if db.ucmp.Compare(f.minKey.Key(), minKey) < 0 {
+			minKey = f.minKey.Key()
+		}
+		if db.ucmp.Compare(f.maxKey.Key(), maxKey) > 0 {
+			maxKey = f.maxKey.Key()
+		}
+	}
+	for _, f := range version.files[1] {
+		if db.overlaps(f, minKey, maxKey) {
+			inputs = append(inputs, f)
+		}
+	}
+
+	db.mu.Unlock()
+	outputs, err := db.mergeTables(version, inputs, 1)
+	db.mu.Lock()
+	if err != nil {
+		db.removeTables(outputs)
+		return err
+	}
+
+	err = db.logAndApply(NewVersionEdit(0, outputs, inputs))
+	if err != nil {
+		// the edit may have reached the manifest, Resume removes the tables if it didn't
+		return err
+	}
+	db.obsolete = append(db.obsolete, inputs...)
+	db.removeObsoleteTables()
+	db.stats.Compactions++
+	return nil
+}
+
+// overlaps reports whether f may hold a user key in [minKey, maxKey]
+func (db *DB) overlaps(f tableFile, minKey, maxKey []byte) bool {
+	return db.ucmp.Compare(minKey, f.maxKey.Key()) <= 0 && db.ucmp.Compare(maxKey, f.minKey.Key()) >= 0
+}
+
+// mergeTables writes the newest entry of every user key in inputs into new tables of the
+// given level, with the merge operands above it applied. Entries covered by a newer range
+// tombstone are dropped, and so are deletions and tombstones when no deeper level of
+// version may hold their keys. Operands that no input entry settles are combined by a
+// partial merge. Expired values are dropped like deletions. The values written go through
+// Opt.CompactionFilter. Tombstones that are
+// kept are split between the outputs, so that their key ranges don't overlap.
+// The tables written so far are returned along with an error
+func (db *DB) mergeTables(version *Version, inputs []tableFile, level int) ([]tableFile, error) {
+	var iters []internalIterator
+	var tombstones []rangeTombstone
+	for _, f := range inputs {
+		file, err := db.fs.Open(dbFilename(db.dirname, fileTypeTable, f.fileNum))
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		stat, err := file.Stat()
+		if err != nil {
+			return nil, err
+		}
+		reader, err := table.NewReader(file, int(stat.Size()), db.cmp)
+		if err != nil {
+			return nil, err
+		}
+		ts, err := db.tableRangeTombstones(reader, f.fileNum)
+		if err != nil {
+			return nil, err
+		}
+		tombstones = append(tombstones, ts...)
+		iters = append(iters, reader.Iterator())
+	}
+	minKey, maxKey := inputs[0].minKey.Key(), inputs[0].maxKey.Key()
+	for _, f := range inputs[1:] {
+		if db.ucmp.Compare(f.minKey.Key(), minKey) < 0 {
+			minKey = f.minKey.Key()
+		}
+		if db.ucmp.Compare(f.maxKey.Key(), maxKey) > 0 {
+			maxKey = f.maxKey.Key()
+		}
+	}
+	filter := db.newEntryFilter(level, !db.inDeeperLevel(version, level, minKey, maxKey), func(key []byte) bool {
+		return db.inDeeperLevel(version, level, key, key)
+	})
+	now := db.opt.now().UnixNano()
+	var kept []rangeTombstone
+	for _, t := range tombstones {
+		if db.ucmp.Compare(t.start, t.end) < 0 && db.inDeeperLevel(version, level, t.start, t.end) {
+			kept = append(kept, t)
+		}
+	}
+
+	var outputs []tableFile
+	var out *tableOutput
+	newOutput := func(lower []byte) error {
+		db.mu.Lock()
+		fileNum := db.versionSet.newFileNum()
+		db.mu.Unlock()
+		outputs = append(outputs, tableFile{fileNum: fileNum, level: level})
+		var err error
+		out, err = db.newTableOutput(fileNum, level, lower)
+		return err
+	}
+	var (
+		curKey  []byte
+		started bool
+		// settled is set once an entry of curKey settles its value, the older ones are
+		// shadowed by it
+		settled bool
+		// written is set once an entry of curKey is in out. Tables only end between keys
+		written  bool
+		operands []mergeEntry
+	)
+	write := func(key util.IKey, value []byte) error {
+		if !written && out != nil && out.w.Len() >= targetFileSize {
+			// the next table starts at key
+			var err error
+			outputs[len(outputs)-1], err = out.finish(kept, key.Key())
+			out = nil
+			if err != nil {
+				return err
+			}
+		}
+		written = true
+		if out == nil {
+			var lower []byte
+			if len(outputs) > 0 {
+				lower = append(lower, key.Key()...)
+			}
+			err := newOutput(lower)
+			if err != nil {
+				return err
+			}
+		}
+		return out.add(key, value)
+	}
+	// writeValue writes the value that settles curKey through the compaction filter
+	writeValue := func(key util.IKey, value []byte) error {
+		if filter != nil {
+			var ok bool
+			key, value, ok = filter(key, value)
+			if !ok {
+				return nil
+			}
+		}
+		return write(key, value)
+	}
+	// endKey writes the merge operands of curKey that no input entry settled. They become a
+	// value if no deeper level holds the key either
+	endKey := func() error {
+		if settled || len(operands) == 0 {
+			return nil
+		}
+		if !db.inDeeperLevel(version, level, curKey, curKey) {
+			e, err := fullMerge(db.opt.MergeOperator, operands, nil)
+			if err != nil {
+				return err
+			}
+			return writeValue(e.ikey, e.value)
+		}
+		for _, e := range partialMerge(db.opt.MergeOperator, operands) {
+			err := write(e.ikey, e.value)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	it := newMergingIter(db.cmp, iters)
+	for {
+		err := it.Next()
+		if err == table.BlockEndErr {
+			break
+		}
+		if err != nil {
+			return outputs, err
+		}
+		if db.abortCompactions.Load() {
+			return outputs, compactionAbortedErr
+		}
+		key := util.IKey(it.Key())
+		if !started || db.ucmp.Compare(key.Key(), curKey) != 0 {
+			err = endKey()
+			if err != nil {
+				return outputs, err
+			}
+			curKey = append(curKey[:0], key.Key()...)
+			started, settled, written = true, false, false
+			operands = operands[:0]
+		}
+		if settled {
+			continue
+		}
+
+		covered := coveringSeq(db.ucmp, tombstones, key.Key(), util.MaxSeqNum) > key.SeqNum()
+		switch {
+		case key.KeyType() == util.IKeyTypeMerge && !covered:
+			if db.opt.MergeOperator == nil {
+				// kept as is until the database is opened with its operator
+				err = write(key, it.Value())
+			} else {
+				operands = append(operands, mergeEntry{
+					ikey:  append(util.IKey{}, key...),
+					value: append([]byte{}, it.Value()...),
+				})
+			}
+		case len(operands) > 0:
+			// the merged value has no TTL
+			settled = true
+			var base []byte
+			if key.KeyType() == util.IKeyTypeSet && !covered {
+				base = it.Value()
+			} else if key.KeyType() == util.IKeyTypeSetWithTTL && !covered && !expired(it.Value(), now) {
+				_, base = splitExpiry(it.Value())
+			}
+			var e mergeEntry
+			e, err = fullMerge(db.opt.MergeOperator, operands, base)
+			if err == nil {
+				err = writeValue(e.ikey, e.value)
+			}
+		case covered:
+			settled = true
+		case key.KeyType() == util.IKeyTypeSetWithTTL && expired(it.Value(), now):
+			// a deletion keeps older values in deeper levels hidden
+			settled = true
+			if db.inDeeperLevel(version, level, key.Key(), key.Key()) {
+				err = write(util.CreateIKey(key.Key(), util.IKeyTypeDelete, key.SeqNum()), nil)
+			}
+		case key.KeyType() == util.IKeyTypeDelete && !db.inDeeperLevel(version, level, key.Key(), key.Key()):
+			settled = true
+		case key.KeyType() == util.IKeyTypeSet || key.KeyType() == util.IKeyTypeSetWithTTL:
+			settled = true
+			err = writeValue(key, it.Value())
+		default:
+			settled = true
+			err = write(key, it.Value())
+		}
+		if err != nil {
+			return outputs, err
+		}
+	}
+	err := endKey()
+	if err != nil {
+		return outputs, err
+	}
+	if out == nil && len(kept) > 0 {
+		err = newOutput(nil)
+		if err != nil {
+			return outputs, err
+		}
+	}
+	if out != nil {
+		outputs[len(outputs)-1], err = out.finish(kept, nil)
+		if err != nil {
+			return outputs, err
+		}
+	}
+	return outputs, nil
+}
+
+// inDeeperLevel reports whether a table below level may hold a key in [minKey, maxKey].
+// Level -1 is above level 0, for the flush of a memtable
+func (db *DB) inDeeperLevel(version *Version, level int, minKey, maxKey []byte) bool {
+	for l := level + 1; l < numLevels; l++ {
+		for _, f := range version.files[l] {
+			if db.overlaps(f, minKey, maxKey) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// tableOutput is a table being written by a compaction. It holds the user keys from
+// lower on, or all keys before the next table if lower is nil
+type tableOutput struct {
+	f     vfs.File
+	w     *table.Writer
+	meta  tableFile
+	lower []byte
+
+	cmp  util.Comparator
+	ucmp util.Comparator
+}
+
+func (db *DB) newTableOutput(fileNum int, level int, lower []byte) (*tableOutput, error) {
+	f, err := db.fs.Create(dbFilename(db.dirname, fileTypeTable, fileNum))
+	if err != nil {
+		return nil, err
+	}
+	w := table.NewWriter(f, table.TableMaxBlockSize, db.cmp)
+	w.SetCompressor(db.opt.compressor(level))
+	return &tableOutput{
+		f:     f,
+		w:     w,
+		meta:  tableFile{fileNum: fileNum, level: level},
+		lower: lower,
+		cmp:   db.cmp,
+		ucmp:  db.ucmp,
+	}, nil
+}
+
+func (o *tableOutput) add(key util.IKey, value []byte) error {
+	if o.meta.minKey == nil {
+		o.meta.minKey = append(util.IKey{}, key...)
+	}
+	o.meta.maxKey = append(o.meta.maxKey[:0], key...)
+	if key.SeqNum() > o.meta.lastSeq {
+		o.meta.lastSeq = key.SeqNum()
+	}
+	return o.w.Add(key, value)
+}
+
+// finish adds the parts of tombstones from o.lower up to upper, nil if the table is the
+// last one, then writes out the table, syncs and closes it
+func (o *tableOutput) finish(tombstones []rangeTombstone, upper []byte) (tableFile, error) {
+	var parts []rangeTombstone
+	for _, t := range tombstones {
+		if o.lower != nil && o.ucmp.Compare(t.start, o.lower) < 0 {
+			t.start = o.lower
+		}
+		if upper != nil && o.ucmp.Compare(t.end, upper) > 0 {
+			t.end = upper
+		}
+		if o.ucmp.Compare(t.start, t.end) < 0 {
+			parts = append(parts, t)
+		}
+	}
+	sortTombstones(o.cmp, parts)
+	for _, t := range parts {
+		o.w.AddRangeDel(t.ikey(), t.end)
+		o.meta.minKey, o.meta.maxKey = extendBounds(o.cmp, o.meta.minKey, o.meta.maxKey, t)
+		if t.seq > o.meta.lastSeq {
+			o.meta.lastSeq = t.seq
+		}
+	}
+
+	err := o.w.Close()
+	if err == nil {
+		err = o.f.Sync()
+	}
+	if err != nil {
+		o.f.Close()
+		return o.meta, err
+	}
+	o.meta.size = o.w.Len()
+	return o.meta, o.f.Close()
+}
+
+// refVersion pins the current version, its tables are kept until unrefVersion.
+// db.mu must be held
+func (db *DB) refVersion() *Version {
+	v := db.versionSet.currentVersion
+	if v.refs == 0 {
+		if db.pinned == nil {
+			db.pinned = make(map[*Version]struct{})
+		}
+		db.pinned[v] = struct{}{}
+	}
+	v.refs++
+	return v
+}
+
+func (db *DB) unrefVersion(v *Version) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	v.refs--
+	if v.refs == 0 {
+		delete(db.pinned, v)
+		db.removeObsoleteTables()
+		if db.closed && len(db.pinned) == 0 {
+			// Close waits for the reads in flight
+			db.bgCond.Broadcast()
+			db.maybeFinishClose()
+		}
+	}
+}
+
+// removeObsoleteTables removes the tables in db.obsolete that no pinned version holds.
+// db.mu must be held
+func (db *DB) removeObsoleteTables() {
+	if len(db.obsolete) == 0 {
+		return
+	}
+	live := db.liveTables()
+	kept := db.obsolete[:0]
+	for _, f := range db.obsolete {
+		if live[f.fileNum] {
+			kept = append(kept, f)
+			continue
+		}
+		db.mmapMu.Lock()
+		db.unmapTable(f.fileNum)
+		db.mmapMu.Unlock()
+		db.forgetRangeTombstones(f.fileNum)
+		db.fs.Remove(dbFilename(db.dirname, fileTypeTable, f.fileNum))
+	}
+	db.obsolete = kept
+}
+
+// liveTables returns the numbers of the tables in the current or a pinned version.
+// db.mu must be held
+func (db *DB) liveTables() map[int]bool {
+	live := make(map[int]bool)
+	add := func(v *Version) {
+		for _, files := range v.files {
+			for _, f := range files {
+				live[f.fileNum] = true
+			}
+		}
+	}
+	add(db.versionSet.currentVersion)
+	for v := range db.pinned {
+		add(v)
+	}
+	return live
+}
+
+// internalIterator walks entries in internal key order. Next returns table.BlockEndErr
+// past the last entry
+type internalIterator interface {
+	Next() error
+	Key() []byte
+	Value() []byte
+}
+
+// mergingIter yields the entries of several iterators in order, using a heap of the
+// iterators that are not exhausted
+type mergingIter struct {
+	h       iterHeap
+	started bool
+}
+
+func newMergingIter(cmp util.Comparator, iters []internalIterator) *mergingIter {
+	return &mergingIter{h: iterHeap{cmp: cmp, iters: iters}}
+}
+
+type iterHeap struct {
+	cmp   util.Comparator
+	iters []internalIterator
+}
+
+func (h iterHeap) Len() int {
+	return len(h.iters)
+}
+
+func (h iterHeap) Less(i, j int) bool {
+	return h.cmp.Compare(h.iters[i].Key(), h.iters[j].Key()) < 0
+}
+
+func (h iterHeap) Swap(i, j int) {
+	h.iters[i], h.iters[j] = h.iters[j], h.iters[i]
+}
+
+func (h *iterHeap) Push(x interface{}) {
+	h.iters = append(h.iters, x.(internalIterator))
+}
+
+func (h *iterHeap) Pop() interface{} {
+	it := h.iters[len(h.iters)-1]
+	h.iters = h.iters[:len(h.iters)-1]
+	return it
+}
+
+func (m *mergingIter) Next() error {
+	if !m.started {
+		m.started = true
+		iters := m.h.iters
+		m.h.iters = nil
+		for _, it := range iters {
+			err := it.Next()
+			if err == nil {
+				m.h.iters = append(m.h.iters, it)
+			} else if err != table.BlockEndErr {
+				return err
+			}
+		}
+		heap.Init(&m.h)
+	} else if m.h.Len() > 0 {
+		err := m.h.iters[0].Next()
+		if err == nil {
+			heap.Fix(&m.h, 0)
+		} else if err == table.BlockEndErr {
+			heap.Pop(&m.h)
+		} else {
+			return err
+		}
+	}
+	if m.h.Len() == 0 {
+		return table.BlockEndErr
+	}
+	return nil
+}
+
+func (m *mergingIter) Key() []byte {
+	if m.h.Len() == 0 {
+		return nil
+	}
+	return m.h.iters[0].Key()
+}
+
+func (m *mergingIter) Value() []byte {
+	if m.h.Len() == 0 {
+		return nil
+	}
+	return m.h.iters[0].Value()
+}
@@ -0,0 +1,147 @@
+package db
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func waitForCompactions(db *DB) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.waitForCompactions()
+}
+
+func TestCompactLevel0(t *testing.T) {
+	clearDir()
+
+	db, err := Open(testdbPath, opt)
+	assert.Nil(t, err)
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 100; i++ {
+			assert.Nil(t, db.Set([]byte(fmt.Sprint("key", i)), []byte(fmt.Sprint("value", round, i))))
+		}
+	}
+	waitForCompactions(db)
+
+	stats := db.Stats()
+	assert.True(t, stats.Flushes > 0)
+	assert.True(t, stats.Compactions > 0)
+	assert.True(t, stats.LevelFiles[0] < opt.l0CompactionTrigger())
+	assert.True(t, stats.LevelFiles[1] > 0)
+	// level 1 tables don't overlap
+	files := db.versionSet.currentVersion.files[1]
+	for i := 1; i < len(files); i++ {
+		assert.True(t, db.cmp.Compare(files[i-1].maxKey, files[i].minKey) < 0)
+	}
+	for i := 0; i < 100; i++ {
+		v, err := db.Get([]byte(fmt.Sprint("key", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprint("value", 2, i), string(v))
+	}
+	db.Close()
+
+	// compacted tables are removed
+	stats = db.Stats()
+	tables := 0
+	names, err := db.fs.List(testdbPath)
+	assert.Nil(t, err)
+	for _, name := range names {
+		ft, _, ok := parseDBFilename(name)
+		if ok && ft == fileTypeTable {
+			tables++
+		}
+	}
+	assert.Equal(t, stats.LevelFiles[0]+stats.LevelFiles[1], tables)
+
+	db, err = Open(testdbPath, opt)
+	assert.Nil(t, err)
+	defer db.Close()
+	for i := 0; i < 100; i++ {
+		v, err := db.Get([]byte(fmt.Sprint("key", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprint("value", 2, i), string(v))
+	}
+}
+
+// writeLevel0 leaves at least n tables in level 0 of the test database and returns the
+// number of keys written
+func writeLevel0(t *testing.T, n int) int {
+	clearDir()
+	db, err := Open(testdbPath, withoutCompaction(opt))
+	assert.Nil(t, err)
+	i := 0
+	for ; db.Stats().LevelFiles[0] < n; i++ {
+		assert.Nil(t, db.Set([]byte(fmt.Sprint("key", i)), []byte("value value value value")))
+	}
+	assert.Nil(t, db.Close())
+	return i
+}
+
+func TestWriteSlowdown(t *testing.T) {
+	writeLevel0(t, 2)
+
+	slowOpt := withoutCompaction(opt)
+	slowOpt.L0SlowdownWritesTrigger = 2
+	db, err := Open(testdbPath, slowOpt)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, db.Set([]byte(fmt.Sprint("new", i)), []byte("value")))
+	}
+	stats := db.Stats()
+	assert.Equal(t, int64(5), stats.SlowdownWrites)
+	assert.True(t, stats.SlowdownDuration >= 5*time.Millisecond)
+	assert.Equal(t, int64(0), stats.StopWrites)
+}
+
+func TestWriteStop(t *testing.T) {
+	writeLevel0(t, 2)
+
+	db, err := Open(testdbPath, withoutCompaction(opt))
+	assert.Nil(t, err)
+	defer db.Close()
+
+	// pretend a compaction is running, so that level 0 stays at the stop trigger
+	db.mu.Lock()
+	db.opt.L0StopWritesTrigger = 2
+	db.bgScheduled = true
+	db.mu.Unlock()
+
+	done := make(chan error)
+	go func() {
+		// the second write doesn't fit the memtable
+		for i := 0; i < 2; i++ {
+			err := db.Set([]byte(fmt.Sprint("new", i)), make([]byte, opt.memTableSize()))
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	for db.Stats().StopWrites == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case <-done:
+		t.Fatal("write was not stopped")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	db.mu.Lock()
+	db.bgScheduled = false
+	db.maybeScheduleCompaction()
+	db.mu.Unlock()
+	assert.Nil(t, <-done)
+
+	stats := db.Stats()
+	assert.Equal(t, int64(1), stats.StopWrites)
+	assert.True(t, stats.StopDuration >= 10*time.Millisecond)
+	assert.True(t, stats.Compactions > 0)
+	v, err := db.Get([]byte("new1"))
+	assert.Nil(t, err)
+	assert.Equal(t, opt.memTableSize(), len(v))
+}
@@ -0,0 +1,139 @@
+package db
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"leveldb_go/vfs"
+	"testing"
+)
+
+func openCrashDB(t *testing.T, opt Opt, fs *vfs.FaultFS) (*DB, Opt) {
+	opt.maxMemorySize, opt.FS, opt.SyncWrites = 300, fs, true
+	db, err := Open(testdbPath, opt)
+	assert.Nil(t, err)
+	return db, opt
+}
+
+// writeWorkload runs synced writes until one fails and returns the acknowledged values
+func writeWorkload(db *DB) map[string]string {
+	acked := make(map[string]string)
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprint("key", i%40)
+		value := fmt.Sprint("value", i)
+		if db.Set([]byte(key), []byte(value)) != nil {
+			break
+		}
+		acked[key] = value
+	}
+	return acked
+}
+
+// stopBackground waits for the flush or compaction in progress and keeps any other from
+// starting, so that a crashed instance no longer touches the files of the next one
+func stopBackground(db *DB) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.bgStopped = true
+	for db.bgScheduled {
+		db.bgCond.Wait()
+	}
+}
+
+// crashAndReopen stops db, crashes the filesystem and checks that every acknowledged write
+// survived the reopen
+func crashAndReopen(t *testing.T, db *DB, opt Opt, fs *vfs.FaultFS, acked map[string]string, desc string) {
+	stopBackground(db)
+	assert.Nil(t, fs.Crash(), desc)
+
+	db2, err := Open(testdbPath, opt)
+	if !assert.Nil(t, err, desc) {
+		return
+	}
+	defer db2.Close()
+	for key, value := range acked {
+		v, err := db2.Get([]byte(key))
+		assert.Nil(t, err, desc)
+		assert.Equal(t, value, string(v), desc)
+	}
+}
+
+// crashAndVerify runs a workload of synced writes until an injected fault makes one of them
+// fail, crashes the filesystem and checks that every acknowledged write survived the reopen
+func crashAndVerify(t *testing.T, kinds vfs.OpKind, n int, torn bool) {
+	desc := fmt.Sprintf("kinds=%d n=%d torn=%v", kinds, n, torn)
+	fs := vfs.NewFault(vfs.NewMem())
+	db, crashOpt := openCrashDB(t, Opt{}, fs)
+	if db == nil {
+		return
+	}
+	fs.InjectFault(kinds, n, torn)
+	acked := writeWorkload(db)
+	crashAndReopen(t, db, crashOpt, fs, acked, desc)
+}
+
+func TestCrashDuringWrites(t *testing.T) {
+	for n := 0; n < 400; n += 7 {
+		crashAndVerify(t, vfs.OpWrite, n, false)
+		crashAndVerify(t, vfs.OpWrite, n, true)
+	}
+}
+
+func TestCrashDuringSyncs(t *testing.T) {
+	for n := 0; n < 400; n += 7 {
+		crashAndVerify(t, vfs.OpSync, n, false)
+	}
+}
+
+func TestCrashDuringFlush(t *testing.T) {
+	// renames only happen when the manifest is switched, so fail everything
+	// around the memtable flushes that happen every few writes
+	for n := 0; n < 40; n++ {
+		crashAndVerify(t, vfs.OpWrite|vfs.OpSync|vfs.OpRename, n, true)
+	}
+}
+
+func TestCrashDuringCompaction(t *testing.T) {
+	// the faults are injected once the writes are acknowledged and level 0 is one table
+	// short of the trigger, so that they land in the final flush and the compaction it
+	// starts rather than in the log
+	compactionFailures := 0
+	for n := 0; n < 20; n++ {
+		desc := fmt.Sprintf("n=%d", n)
+		fs := vfs.NewFault(vfs.NewMem())
+		db, crashOpt := openCrashDB(t, Opt{L0CompactionTrigger: 2}, fs)
+		if db == nil {
+			return
+		}
+		acked := writeWorkload(db)
+		assert.Equal(t, 40, len(acked), desc)
+		db.mu.Lock()
+		assert.Nil(t, db.flushMemTable(), desc)
+		assert.Nil(t, db.waitForCompactions(), desc)
+		if len(db.versionSet.currentVersion.files[0]) == 0 {
+			db.mu.Unlock()
+			assert.Nil(t, db.Set([]byte("key0"), []byte("flushed")), desc)
+			acked["key0"] = "flushed"
+			db.mu.Lock()
+			assert.Nil(t, db.flushMemTable(), desc)
+		}
+		db.mu.Unlock()
+		assert.Nil(t, db.Set([]byte("key1"), []byte("compacted")), desc)
+		acked["key1"] = "compacted"
+
+		fs.InjectFault(vfs.OpWrite|vfs.OpSync, n, true)
+		db.mu.Lock()
+		stats := db.stats
+		db.flushMemTable()
+		db.waitForCompactions()
+		if db.bgErr != nil && db.stats.Flushes > stats.Flushes && db.stats.Compactions == stats.Compactions {
+			compactionFailures++
+		}
+		db.mu.Unlock()
+		crashAndReopen(t, db, crashOpt, fs, acked, desc)
+	}
+	assert.True(t, compactionFailures > 0)
+}
+
+func TestCrashWithoutFault(t *testing.T) {
+	crashAndVerify(t, 0, 0, false)
+}
@@ -1,22 +1,27 @@
 package db
 
 import (
+	"container/list"
+	"context"
 	"errors"
 	"io"
 	"leveldb_go/memdb"
 	"leveldb_go/record"
 	"leveldb_go/table"
 	"leveldb_go/util"
-	"os"
-	"syscall"
+	"leveldb_go/vfs"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var LockErr = errors.New("cannot acquire file lock")
 
 type DB struct {
-	dirname      string
-	mem          *memdb.MemDB
-	lastTableNum int
+	fs      vfs.FS
+	dirname string
+	mem     *memTable
 
 	versionSet *VersionSet // version is created when memtable is filled or when compaction occurs
 	seqNum     uint64
@@ -24,61 +29,228 @@ type DB struct {
 	flock io.Closer
 
 	logWriter *record.Writer
+	logNum    int
 	manifest  *manifest
 
+	// inMemory databases have no lock, log or manifest and keep their tables in fs
+	inMemory bool
+	readOnly bool
+	// secondary is set for instances following a primary's files, see OpenSecondary
+	secondary *secondary
+
+	// mapped holds the readers of memory mapped tables when Opt.MmapBytes is set, cached
+	// the most recently used tables past the budget, in the order of cacheLRU
+	mmapMu     sync.Mutex
+	mmapBudget *table.MmapBudget
+	mapped     map[int]mappedTable
+	cached     map[int]*cachedTable
+	cacheLRU   *list.List
+	// rangeDels caches the range tombstones of the tables read so far
+	rangeDelMu sync.Mutex
+	rangeDels  map[int][]rangeTombstone
+
 	cmp  util.Comparator
 	ucmp util.Comparator
 
 	opt Opt
+
+	// mu guards the fields above that change after Open. writers is the queue of Write
+	// calls, see Write
+	mu      sync.Mutex
+	writers []*writer
+
+	// imm is the memtable being flushed in the background, nil if there is none.
+	// Its entries are in the log immLogNum
+	imm       *memTable
+	immLogNum int
+	// bgCond is broadcast when background work finishes, see maybeScheduleCompaction
+	bgCond      *sync.Cond
+	bgScheduled bool
+	bgErr       error
+	// closed is set once Close is called, bgStopped once it no longer needs background
+	// work. abortCompactions is set when the deadline of CloseContext passes, closePending
+	// when CloseContext returned before the background work and reads were done
+	closed           bool
+	bgStopped        bool
+	abortCompactions atomic.Bool
+	closePending     bool
+	// pinned holds the versions read by Gets in flight. obsolete holds the tables removed
+	// by compactions that are still in a pinned version
+	pinned   map[*Version]struct{}
+	obsolete []tableFile
+	stats    Stats
 }
 
 type Opt struct {
 	maxMemorySize int
+
+	// FS is the filesystem holding the database files, vfs.Default if nil
+	FS vfs.FS
+	// SyncWrites syncs the log before a write is acknowledged, so that it survives a machine crash
+	// rather than just a process crash
+	SyncWrites bool
+	// ReadOnly opens the database without locking it or writing any file, so that it
+	// can be read while another process writes to it. Mutating calls fail with ReadOnlyErr.
+	// The state read at open is never refreshed: later writes stay invisible, and reads
+	// that reach a table the writer has since compacted away fail. Reopen the database,
+	// or follow the writer with OpenSecondary
+	ReadOnly bool
+	// MemoryLimit bounds the bytes held by a database opened with OpenInMemory,
+	// writes past it fail with MemoryLimitErr. 0 means no limit
+	MemoryLimit int
+	// Compression is used for the tables of every level without an entry in
+	// LevelCompression, table.SnappyCompression if nil
+	Compression table.Compressor
+	// LevelCompression selects the compression of the tables written to each level,
+	// e.g. table.NoCompression for level 0 and table.ZlibCompression for the last level
+	LevelCompression []table.Compressor
+	// MemTable creates the memtables, memdb.NewSkipList if nil
+	MemTable memdb.Factory
+	// MaxGroupSize bounds the bytes of concurrent writes committed together, 1MB if 0
+	MaxGroupSize int
+	// MmapBytes enables memory mapping tables for reads, up to this many bytes in total.
+	// Tables past the budget are read with ReadAt, the last 100 used of them stay open. 0
+	// disables mapping
+	MmapBytes int64
+	// L0CompactionTrigger is the number of level 0 tables that starts a compaction into
+	// level 1, 4 if 0
+	L0CompactionTrigger int
+	// L0SlowdownWritesTrigger is the number of level 0 tables at which every write is
+	// delayed by 1ms to let compaction catch up, 8 if 0
+	L0SlowdownWritesTrigger int
+	// L0StopWritesTrigger is the number of level 0 tables at which writes wait until
+	// compaction has reduced them, 12 if 0
+	L0StopWritesTrigger int
+	// MergeOperator combines the operands written by Merge, which fails if it is nil
+	MergeOperator MergeOperator
+	// CompactionFilter, if set, may drop or rewrite values as they are flushed or compacted
+	CompactionFilter CompactionFilter
+	// Now is the clock deciding when values set with a TTL expire, time.Now if nil
+	Now func() time.Time
+}
+
+const defaultMaxMemorySize = 4 << 20
+
+func (o Opt) memTableSize() int {
+	if o.maxMemorySize == 0 {
+		return defaultMaxMemorySize
+	}
+	return o.maxMemorySize
+}
+
+func (o Opt) compressor(level int) table.Compressor {
+	if level < len(o.LevelCompression) && o.LevelCompression[level] != nil {
+		return o.LevelCompression[level]
+	}
+	if o.Compression != nil {
+		return o.Compression
+	}
+	return table.SnappyCompression
+}
+
+func (o Opt) newMemTable(cmp util.Comparator) *memTable {
+	if o.MemTable == nil {
+		return &memTable{MemTable: memdb.NewSkipList(cmp)}
+	}
+	return &memTable{MemTable: o.MemTable(cmp)}
+}
+
+func (o Opt) fs() vfs.FS {
+	if o.FS == nil {
+		return vfs.Default
+	}
+	return o.FS
 }
 
 func (db *DB) Get(key []byte) ([]byte, error) {
-	ikey := util.CreateIKey(key, util.IKeyTypeSet, db.seqNum)
-	val, ok := db.mem.GetIKey(ikey)
-	if ok {
-		return val, nil
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return nil, ErrClosed
+	}
+	mem, imm, seq := db.mem, db.imm, db.seqNum
+	version := db.refVersion()
+	db.mu.Unlock()
+	defer db.unrefVersion(version)
+
+	l := &lookup{
+		ikey:       util.CreateIKey(key, util.IKeyTypeSet, seq),
+		copyValues: db.opt.MmapBytes > 0,
+		now:        db.opt.now().UnixNano(),
 	}
-	version := db.versionSet.currentVersion // should acquire and release version
-	return db.getFromDisk(ikey, version)
+	for _, m := range []*memTable{mem, imm} {
+		if m == nil {
+			continue
+		}
+		l.addTombstones(db.ucmp, m.rangeTombstones())
+		if l.tombSeq == 0 && !m.typed.Load() {
+			if val, ok := m.Get(l.ikey); ok {
+				return val, nil
+			}
+		} else if l.search(m.NewIterator()) {
+			// the seek gives the sequence numbers and types that tombstones, merge
+			// operands and TTLs need
+			return l.result(db.opt.MergeOperator)
+		}
+	}
+	err := db.getFromDisk(l, version)
+	if err != nil {
+		return nil, err
+	}
+	return l.result(db.opt.MergeOperator)
 }
 
-func (db *DB) getFromDisk(ikey util.IKey, version *Version) ([]byte, error) {
+// getFromDisk searches the tables of version for l. A table that can't be read fails the
+// lookup rather than being skipped, as it may hold a deletion of an older value
+func (db *DB) getFromDisk(l *lookup, version *Version) error {
 	for level := 0; level < numLevels; level++ {
-		for _, meta := range version.files[level] {
-			if db.ucmp.Compare(ikey.Key(), meta.minKey.Key()) >= 0 && db.cmp.Compare(ikey, meta.maxKey) <= 0 {
-				v, err := db.lookupTable(ikey, meta.fileNum)
-				if err == nil {
-					return v, nil
+		files := version.files[level]
+		for i := range files {
+			meta := files[i]
+			if level == 0 {
+				// level 0 tables may overlap, so the newest one has to be checked first
+				meta = files[len(files)-1-i]
+			}
+			if db.ucmp.Compare(l.ikey.Key(), meta.minKey.Key()) >= 0 && db.cmp.Compare(l.ikey, meta.maxKey) <= 0 {
+				done, err := db.lookupTable(l, meta.fileNum)
+				if err != nil || done {
+					return err
 				}
 			}
 		}
 	}
-	return nil, errors.New("not found")
+	return nil
 }
 
-func (db *DB) lookupTable(ikey util.IKey, fileNum int) ([]byte, error) {
-	f, err := os.Open(dbFilename(db.dirname, fileTypeTable, fileNum))
+// lookupTable adds the range tombstones and entries of a table to l and reports whether
+// they settle the value
+func (db *DB) lookupTable(l *lookup, fileNum int) (bool, error) {
+	if db.opt.MmapBytes > 0 {
+		return db.lookupMappedTable(l, fileNum)
+	}
+	f, err := db.fs.Open(dbFilename(db.dirname, fileTypeTable, fileNum))
 	if err != nil {
-		return nil, err
+		return false, err
 	}
+	defer f.Close()
 	stat, err := f.Stat()
 	if err != nil {
-		return nil, err
+		return false, err
 	}
 	reader, err := table.NewReader(f, int(stat.Size()), db.cmp)
 	if err != nil {
-		return nil, err
+		return false, err
 	}
-	it := reader.Iterator()
-	v, ok := it.GetIKey(ikey)
-	if ok {
-		return v, nil
+	return db.searchTable(reader, fileNum, l)
+}
+
+func (db *DB) searchTable(r *table.Reader, fileNum int, l *lookup) (bool, error) {
+	tombstones, err := db.tableRangeTombstones(r, fileNum)
+	if err != nil {
+		return false, err
 	}
-	return nil, errors.New("not found")
+	l.addTombstones(db.ucmp, tombstones)
+	return l.search(r.Iterator()), nil
 }
 
 func (db *DB) nextSeqNum() uint64 {
@@ -87,77 +259,297 @@ func (db *DB) nextSeqNum() uint64 {
 }
 
 func (db *DB) Set(key, value []byte) error {
-	if len(value)+db.mem.ApproxSize() > db.opt.maxMemorySize {
-		err := db.writeMemTable()
+	b := NewWriteBatch()
+	b.Set(key, value)
+	return db.Write(b)
+}
+
+// DeleteRange deletes the keys in [start, end) with a single range tombstone, whatever
+// their number
+func (db *DB) DeleteRange(start, end []byte) error {
+	b := NewWriteBatch()
+	b.DeleteRange(start, end)
+	return db.Write(b)
+}
+
+func (db *DB) writeToLog(b *batch) error {
+	if db.inMemory {
+		return nil
+	}
+	_, err := db.logWriter.Write(b.data)
+	if err != nil {
+		return err
+	}
+	if db.opt.SyncWrites {
+		return db.logWriter.Sync()
+	}
+	return db.logWriter.Flush()
+}
+
+// ErrClosed is returned by operations on a closed database
+var ErrClosed = errors.New("database is closed")
+
+// Close is CloseContext without a deadline
+func (db *DB) Close() error {
+	return db.CloseContext(context.Background())
+}
+
+// CloseContext stops accepting operations, lets queued writes finish, flushes the memtable
+// and waits for background work and reads in flight before releasing the database.
+// Compactions still running when ctx is done are aborted, their input stays in place.
+// Once ctx is done it stops waiting and returns ctx.Err(), the files are then released
+// when the last flush or read in flight finishes. Otherwise it returns the first error
+// encountered, including the background error if there is one. Closing a closed
+// database does nothing
+func (db *DB) CloseContext(ctx context.Context) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return nil
+	}
+	db.closed = true
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			db.abortCompactions.Store(true)
+			// wakes the waits of close, which give up once ctx is done
+			db.mu.Lock()
+			db.bgCond.Broadcast()
+			db.mu.Unlock()
+		case <-done:
+		}
+	}()
+	return db.runExclusive(func() error {
+		return db.close(ctx)
+	})
+}
+
+func (db *DB) close(ctx context.Context) error {
+	var err error
+	if !db.inMemory && !db.readOnly {
+		// the memtable is still in the log if the flush fails
+		err = db.flushMemTableContext(ctx)
+	}
+	db.bgStopped = true
+	for (db.bgScheduled || len(db.pinned) > 0) && ctx.Err() == nil {
+		db.bgCond.Wait()
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	if db.bgScheduled || len(db.pinned) > 0 {
+		// the last of them releases the files, see maybeFinishClose
+		db.closePending = true
+		return err
+	}
+	if rerr := db.release(); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// maybeFinishClose releases the files of a database whose CloseContext gave up waiting,
+// once the background work and the reads in flight are done. db.mu must be held
+func (db *DB) maybeFinishClose() {
+	if !db.closePending || db.bgScheduled || len(db.pinned) > 0 {
+		return
+	}
+	db.closePending = false
+	db.release()
+}
+
+// release closes the files of a closed database and removes the tables left obsolete.
+// db.mu must be held
+func (db *DB) release() error {
+	var err error
+	db.unmapTables()
+	db.removeTables(db.obsolete)
+	db.obsolete = nil
+	if !db.inMemory && !db.readOnly {
+		if cerr := db.manifest.Close(); err == nil {
+			err = cerr
+		}
+		if cerr := db.logWriter.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if db.flock != nil {
+		if cerr := db.flock.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// switchMemTable makes the memtable immutable and schedules its flush. Later writes go
+// to an empty memtable and a new log. db.mu must be held and db.imm must be nil
+func (db *DB) switchMemTable() error {
+	if !db.inMemory {
+		logNum := db.versionSet.newFileNum()
+		logFile, err := db.fs.Create(dbFilename(db.dirname, fileTypeLog, logNum))
 		if err != nil {
 			return err
 		}
-		db.mem = memdb.NewMemDB(db.cmp)
+		db.logWriter.Close()
+		db.logWriter = record.NewWriter(logFile)
+		db.immLogNum = db.logNum
+		db.logNum = logNum
 	}
-
-	ikey := util.CreateIKey(key, util.IKeyTypeSet, db.nextSeqNum())
-	db.mem.Put(ikey, value)
+	db.imm = db.mem
+	db.mem = db.opt.newMemTable(db.cmp)
+	db.maybeScheduleCompaction()
 	return nil
 }
 
-func (db *DB) Close() error {
-	db.writeMemTable()
-	db.manifest.Close()
-	db.logWriter.Close()
-	db.flock.Close()
+// flushMemTable writes the memtable out to a level 0 table and waits until it is in the
+// current version. db.mu must be held
+func (db *DB) flushMemTable() error {
+	return db.flushMemTableContext(context.Background())
+}
+
+// flushMemTableContext is flushMemTable giving up the wait with ctx.Err() once ctx is
+// done, the flush goes on in the background. bgCond has to be broadcast when ctx is done
+func (db *DB) flushMemTableContext(ctx context.Context) error {
+	for db.imm != nil && db.bgErr == nil && ctx.Err() == nil {
+		db.bgCond.Wait()
+	}
+	if db.bgErr == nil && ctx.Err() == nil && db.mem.ApproximateMemoryUsage() > 0 {
+		err := db.switchMemTable()
+		if err != nil {
+			return err
+		}
+	}
+	for db.imm != nil && db.bgErr == nil && ctx.Err() == nil {
+		db.bgCond.Wait()
+	}
+	if db.bgErr == nil && db.imm != nil {
+		return ctx.Err()
+	}
+	return db.bgErr
+}
+
+// logAndApply persists the edit to the manifest before installing it as the current version
+func (db *DB) logAndApply(ve *VersionEdit) error {
+	ve.nextFileNum = db.versionSet.nextFileNum
+	if db.inMemory {
+		db.versionSet.ApplyVersionEdit(ve)
+		return nil
+	}
+	err := db.manifest.logVersionEdit(ve)
+	if err != nil {
+		return err
+	}
+	db.versionSet.ApplyVersionEdit(ve)
 	return nil
 }
 
-func (db *DB) writeMemTable() error {
-	// need to add version with this table
-	// do we need to copy memtable to keep iterator consistent?
-	// optimizations for tombstoned entries/entries with more recent sequence num
-	f, err := os.Create(dbFilename(db.dirname, fileTypeTable, db.lastTableNum))
+// recover replays the logs that are still live according to the manifest, writes their
+// contents out as a table and starts a new log
+func (db *DB) recover() error {
+	logs, err := db.replayLogs()
+	if err != nil {
+		return err
+	}
 
+	logNum := db.versionSet.newFileNum()
+	logFile, err := db.fs.Create(dbFilename(db.dirname, fileTypeLog, logNum))
 	if err != nil {
 		return err
 	}
-	writer := table.NewWriter(f, table.TableMaxBlockSize)
-
-	var minKey, maxKey util.IKey
-	it := db.mem.Iterator()
-	for it.Next() == nil {
-		if minKey == nil {
-			minKey = it.Key()
-			maxKey = it.Key()
-		} else {
-			if db.cmp.Compare(minKey, it.Key()) > 0 {
-				minKey = it.Key()
-			}
-			if db.cmp.Compare(maxKey, it.Key()) < 0 {
-				maxKey = it.Key()
-			}
+	db.logWriter = record.NewWriter(logFile)
+	db.logNum = logNum
+
+	ve := NewVersionEdit(db.seqNum, nil, nil)
+	ve.logNum = logNum
+	if db.mem.ApproximateMemoryUsage() > 0 {
+		filter := db.flushFilter(db.versionSet.currentVersion, db.mem)
+		meta, err := buildTable(db.fs, db.dirname, db.versionSet.newFileNum(), db.mem, db.cmp, db.opt.compressor(0), filter)
+		if err != nil {
+			return err
 		}
-
-		writer.Add(it.Key(), it.Value())
+		if meta.minKey != nil {
+			ve.filesToAdd = append(ve.filesToAdd, meta)
+		}
+		db.mem = db.opt.newMemTable(db.cmp)
 	}
-	err = writer.Close()
+	err = db.logAndApply(ve)
 	if err != nil {
 		return err
 	}
 
-	ve := NewVersionEdit(db.seqNum, []tableFile{{
-		fileNum: db.lastTableNum,
-		minKey:  minKey,
-		maxKey:  maxKey,
-		level:   0,
-		size:    writer.Len(),
-		lastSeq: db.seqNum,
-	}}, nil)
-	db.lastTableNum++
+	for _, num := range logs {
+		db.fs.Remove(dbFilename(db.dirname, fileTypeLog, num))
+	}
+	return nil
+}
 
-	err = db.manifest.logVersionEdit(ve)
+// replayLogs replays the live logs into the memtable and returns their numbers
+func (db *DB) replayLogs() ([]int, error) {
+	names, err := db.fs.List(db.dirname)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	db.versionSet.ApplyVersionEdit(ve)
+	var logs []int
+	for _, name := range names {
+		ft, num, ok := parseDBFilename(name)
+		if ok && ft == fileTypeLog && num >= db.versionSet.logNum {
+			logs = append(logs, num)
+			db.versionSet.markFileNumUsed(num)
+		}
+	}
+	sort.Ints(logs)
 
-	return nil
+	for _, num := range logs {
+		maxSeq, err := replayLog(db.fs, dbFilename(db.dirname, fileTypeLog, num), db.mem)
+		if err != nil {
+			return nil, err
+		}
+		if maxSeq > db.seqNum {
+			db.seqNum = maxSeq
+		}
+	}
+	return logs, nil
+}
+
+// replayLog inserts every intact batch of the log into mem and returns the largest sequence number seen.
+// Reading stops at the first unreadable record, which is expected for the tail of a log after a crash
+func replayLog(fs vfs.FS, filename string, mem memdb.MemTable) (uint64, error) {
+	maxSeq, _, err := replayLogFrom(fs, filename, mem, 0)
+	return maxSeq, err
+}
+
+// replayLogFrom is replayLog starting at offset. It also returns the offset right after the
+// last batch read, where a later call can pick up the batches appended since
+func replayLogFrom(fs vfs.FS, filename string, mem memdb.MemTable, offset int64) (uint64, int64, error) {
+	f, err := fs.Open(filename)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	var maxSeq uint64
+	reader, err := record.NewReaderAt(f, offset)
+	if err != nil {
+		return 0, 0, err
+	}
+	for {
+		data, err := reader.ReadBlock()
+		if err != nil {
+			break
+		}
+		b := batch{data: data}
+		// corrupted batches are skipped, the records before the corruption are kept
+		b.forEach(func(ikey util.IKey, value []byte) {
+			mem.Add(ikey, value)
+			if ikey.SeqNum() > maxSeq {
+				maxSeq = ikey.SeqNum()
+			}
+		})
+	}
+	return maxSeq, reader.Offset(), nil
 }
 
 func (db *DB) writeIterToTable() {
@@ -165,38 +557,44 @@ func (db *DB) writeIterToTable() {
 }
 
 func Open(dirname string, opt Opt) (*DB, error) {
+	if opt.ReadOnly {
+		return openReadOnly(dirname, opt)
+	}
 	// lock directory first
-	err := os.MkdirAll(dirname, 0755)
+	fs := opt.fs()
+	err := fs.MkdirAll(dirname, 0755)
+	if err != nil {
+		return nil, err
+	}
+	flock, err := lockDB(fs, dirname)
 	if err != nil {
 		return nil, err
 	}
-	flock, err := lockDB(dirname)
 
-	exist, err := isManifestExist(dirname)
+	exist, err := isManifestExist(fs, dirname)
 	if err != nil {
+		flock.Close()
 		return nil, err
 	}
 	if !exist {
-		err := initManifest(dirname)
+		err := initManifest(fs, dirname)
 		if err != nil {
+			flock.Close()
 			return nil, err
 		}
 	}
 
-	logFile, err := os.Create(dbFilename(dirname, fileTypeLog, 0))
-	memtable := memdb.NewMemDB(util.IKeyStringCmp)
-	logWriter := record.NewWriter(logFile)
-
 	// read manifest in, create vs and write out new manifest
-	manifest, vs, err := openManifest(dirname)
+	manifest, vs, err := openManifest(fs, dirname)
 	if err != nil {
+		flock.Close()
 		return nil, err
 	}
 
-	return &DB{
+	db := &DB{
+		fs:         fs,
 		dirname:    dirname,
-		mem:        memtable,
-		logWriter:  logWriter,
+		mem:        opt.newMemTable(util.IKeyStringCmp),
 		flock:      flock,
 		cmp:        util.IKeyStringCmp,
 		ucmp:       &util.StringComparator{},
@@ -204,20 +602,28 @@ func Open(dirname string, opt Opt) (*DB, error) {
 		versionSet: vs,
 		manifest:   manifest,
 		seqNum:     vs.currentVersion.seqNum(),
-	}, nil
-
-}
-
-func lockDB(dirname string) (io.Closer, error) {
-	lockFile := dbFilename(dirname, fileTypeLock, 0)
-	f, err := os.Create(lockFile)
+	}
+	db.bgCond = sync.NewCond(&db.mu)
+	err = db.recover()
 	if err != nil {
+		if db.logWriter != nil {
+			db.logWriter.Close()
+		}
+		manifest.Close()
+		flock.Close()
 		return nil, err
 	}
-	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
-	if err != nil {
-		f.Close()
+	// level 0 may have been left past the compaction trigger
+	db.mu.Lock()
+	db.maybeScheduleCompaction()
+	db.mu.Unlock()
+	return db, nil
+}
+
+func lockDB(fs vfs.FS, dirname string) (io.Closer, error) {
+	flock, err := fs.Lock(dbFilename(dirname, fileTypeLock, 0))
+	if err == vfs.LockedErr {
 		return nil, LockErr
 	}
-	return f, nil
+	return flock, err
 }
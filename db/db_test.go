@@ -3,6 +3,9 @@ package db
 import (
 	"fmt"
 	"github.com/stretchr/testify/assert"
+	"leveldb_go/memdb"
+	"leveldb_go/table"
+	"leveldb_go/vfs"
 	"os"
 	"syscall"
 	"testing"
@@ -156,3 +159,245 @@ func TestReadWriteDBClose(t *testing.T) {
 func TestSnapshotRead(t *testing.T) {
 
 }
+
+func TestFileNumbersSurviveReopen(t *testing.T) {
+	clearDir()
+
+	for round := 0; round < 3; round++ {
+		db, err := Open(testdbPath, Opt{maxMemorySize: 50})
+		assert.Nil(t, err)
+		for i := 0; i < 20; i++ {
+			db.Set([]byte(fmt.Sprint("key", i)), []byte(fmt.Sprint("value", round, "-", i)))
+		}
+		db.Close()
+	}
+
+	db, err := Open(testdbPath, opt)
+	assert.Nil(t, err)
+	defer db.Close()
+	for i := 0; i < 20; i++ {
+		v, err := db.Get([]byte(fmt.Sprint("key", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprint("value", 2, "-", i), string(v))
+	}
+}
+
+func TestRecoverFromLog(t *testing.T) {
+	clearDir()
+
+	db, err := Open(testdbPath, Opt{maxMemorySize: 10000})
+	assert.Nil(t, err)
+	db.Set([]byte("hello"), []byte("world"))
+	// simulate a crash, the write is only in the log
+	db.flock.Close()
+
+	db2, err := Open(testdbPath, opt)
+	assert.Nil(t, err)
+	defer db2.Close()
+	v, err := db2.Get([]byte("hello"))
+	assert.Nil(t, err)
+	assert.Equal(t, "world", string(v))
+	assert.True(t, db2.seqNum >= 1)
+}
+
+func TestDBMemFS(t *testing.T) {
+	clearDir()
+	fs := vfs.NewMem()
+	memOpt := Opt{maxMemorySize: 200, FS: fs}
+
+	var testKVs []testKV
+	for i := 0; i < 100; i++ {
+		testKVs = append(testKVs, testKV{
+			fmt.Sprint("key", i),
+			fmt.Sprint("value", i),
+		})
+	}
+
+	db, err := Open(testdbPath, memOpt)
+	assert.Nil(t, err)
+	for _, kv := range testKVs {
+		db.Set([]byte(kv.key), []byte(kv.value))
+	}
+	db.Close()
+
+	// nothing touched the disk
+	_, err = os.Stat(testdbPath + "/CURRENT")
+	assert.True(t, os.IsNotExist(err))
+
+	db2, err := Open(testdbPath, memOpt)
+	assert.Nil(t, err)
+	defer db2.Close()
+	for _, kv := range testKVs {
+		v, err := db2.Get([]byte(kv.key))
+		assert.Nil(t, err)
+		assert.Equal(t, kv.value, string(v))
+	}
+}
+
+func tableProperties(t *testing.T, db *DB, fileNum int) *table.Properties {
+	f, err := db.fs.Open(dbFilename(db.dirname, fileTypeTable, fileNum))
+	assert.Nil(t, err)
+	defer f.Close()
+	stat, err := f.Stat()
+	assert.Nil(t, err)
+	r, err := table.NewReader(f, int(stat.Size()), db.cmp)
+	assert.Nil(t, err)
+	props, err := r.Properties()
+	assert.Nil(t, err)
+	return props
+}
+
+// withoutCompaction keeps every flushed table in level 0
+func withoutCompaction(o Opt) Opt {
+	o.L0CompactionTrigger = 1000
+	o.L0SlowdownWritesTrigger = 1000
+	o.L0StopWritesTrigger = 1000
+	return o
+}
+
+func TestLevelCompression(t *testing.T) {
+	clearDir()
+
+	levelOpt := opt
+	levelOpt.LevelCompression = make([]table.Compressor, numLevels)
+	levelOpt.LevelCompression[0] = table.NoCompression
+	levelOpt.LevelCompression[numLevels-1] = table.ZlibCompression
+	levelOpt = withoutCompaction(levelOpt)
+	db, err := Open(testdbPath, levelOpt)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	for i := 0; i < 20; i++ {
+		db.Set([]byte(fmt.Sprint("key", i)), []byte("value value value value"))
+	}
+	ext := "testdb/ext.sst"
+	writeSST(t, ext, []testKV{{"z1", "value value value value"}, {"z2", "value value value value"}})
+	assert.Nil(t, db.IngestExternalFiles([]string{ext}))
+
+	version := db.versionSet.currentVersion
+	assert.True(t, len(version.files[0]) > 0)
+	for _, f := range version.files[0] {
+		assert.Equal(t, "none", tableProperties(t, db, f.fileNum).Compression)
+	}
+	assert.Equal(t, 1, len(version.files[numLevels-1]))
+	assert.Equal(t, "zlib", tableProperties(t, db, version.files[numLevels-1][0].fileNum).Compression)
+
+	v, err := db.Get([]byte("z2"))
+	assert.Nil(t, err)
+	assert.Equal(t, "value value value value", string(v))
+}
+
+func TestMmapTables(t *testing.T) {
+	clearDir()
+
+	var testKVs []testKV
+	for i := 0; i < 100; i++ {
+		testKVs = append(testKVs, testKV{fmt.Sprint("key", i), fmt.Sprint("value", i)})
+	}
+	db, err := Open(testdbPath, withoutCompaction(opt))
+	assert.Nil(t, err)
+	for _, kv := range testKVs {
+		db.Set([]byte(kv.key), []byte(kv.value))
+	}
+	db.Close()
+
+	// the first budget maps every table, the second only one of them
+	tables := 0
+	var tableSize int64
+	for _, budget := range []int64{1 << 20, 0} {
+		mmapOpt := withoutCompaction(opt)
+		mmapOpt.MmapBytes = budget
+		if budget == 0 {
+			mmapOpt.MmapBytes = tableSize
+		}
+		db, err = Open(testdbPath, mmapOpt)
+		assert.Nil(t, err)
+		files := db.versionSet.currentVersion.files[0]
+		for _, kv := range testKVs {
+			v, err := db.Get([]byte(kv.key))
+			assert.Nil(t, err)
+			assert.Equal(t, kv.value, string(v))
+		}
+		assert.True(t, db.mmapBudget.Used() <= mmapOpt.MmapBytes)
+		if budget == 0 {
+			assert.True(t, len(db.mapped) > 0 && len(db.mapped) < tables)
+			// the tables past the budget stay open as well
+			assert.Equal(t, tables, len(db.mapped)+len(db.cached))
+		} else {
+			tables = len(files)
+			assert.Equal(t, tables, len(db.mapped))
+			for _, f := range files {
+				if int64(f.size) > tableSize {
+					tableSize = int64(f.size)
+				}
+			}
+		}
+		db.Close()
+		assert.Equal(t, int64(0), db.mmapBudget.Used())
+	}
+}
+
+func TestMemTableOptions(t *testing.T) {
+	var testKVs []testKV
+	for i := 0; i < 200; i++ {
+		testKVs = append(testKVs, testKV{fmt.Sprint("key", i), fmt.Sprint("value", i)})
+	}
+
+	for _, factory := range []memdb.Factory{memdb.NewVector, memdb.HashPrefix(4)} {
+		clearDir()
+		memOpt := Opt{maxMemorySize: 1000, MemTable: factory}
+		db, err := Open(testdbPath, memOpt)
+		assert.Nil(t, err)
+		for _, kv := range testKVs {
+			assert.Nil(t, db.Set([]byte(kv.key), []byte(kv.value)))
+		}
+		db.Set([]byte("key7"), []byte("new"))
+		for _, kv := range testKVs {
+			v, err := db.Get([]byte(kv.key))
+			assert.Nil(t, err)
+			if kv.key == "key7" {
+				assert.Equal(t, "new", string(v))
+			} else {
+				assert.Equal(t, kv.value, string(v))
+			}
+		}
+		db.Close()
+
+		db, err = Open(testdbPath, memOpt)
+		assert.Nil(t, err)
+		v, err := db.Get([]byte("key7"))
+		assert.Nil(t, err)
+		assert.Equal(t, "new", string(v))
+		db.Close()
+	}
+}
+
+func TestCachedTablesBounded(t *testing.T) {
+	clearDir()
+
+	db, err := Open(testdbPath, withoutCompaction(opt))
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		db.Set([]byte(fmt.Sprint("key", i)), []byte(fmt.Sprint("value", i)))
+	}
+	db.Close()
+
+	// a budget too small for any table
+	mmapOpt := withoutCompaction(opt)
+	mmapOpt.MmapBytes = 1
+	db, err = Open(testdbPath, mmapOpt)
+	assert.Nil(t, err)
+	defer db.Close()
+	assert.True(t, len(db.versionSet.currentVersion.files[0]) > maxCachedTables)
+	for i := 0; i < 1000; i++ {
+		v, err := db.Get([]byte(fmt.Sprint("key", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprint("value", i), string(v))
+	}
+	assert.Equal(t, 0, len(db.mapped))
+	assert.Equal(t, maxCachedTables, len(db.cached))
+	assert.Equal(t, maxCachedTables, db.cacheLRU.Len())
+	for _, c := range db.cached {
+		assert.Equal(t, 0, c.refs)
+	}
+}
@@ -0,0 +1,51 @@
+package db
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Destroy removes the database in dirname. Only files that belong to the database are removed,
+// and the directory itself is removed once it is empty. It fails with LockErr if the database
+// is held open by another process.
+func Destroy(dirname string, opt Opt) error {
+	fs := opt.fs()
+	names, err := fs.List(dirname)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	flock, err := lockDB(fs, dirname)
+	if err != nil {
+		return err
+	}
+
+	var firstErr error
+	for _, name := range names {
+		ft, _, ok := parseDBFilename(name)
+		if !ok || ft == fileTypeLock {
+			continue
+		}
+		err = fs.Remove(filepath.Join(dirname, name))
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	// the lock file goes last so that nobody can open the database while it is half removed
+	err = flock.Close()
+	if err != nil && firstErr == nil {
+		firstErr = err
+	}
+	err = fs.Remove(dbFilename(dirname, fileTypeLock, 0))
+	if err != nil && firstErr == nil {
+		firstErr = err
+	}
+
+	// leave the directory in place if it holds files we do not own
+	fs.Remove(dirname)
+	return firstErr
+}
@@ -0,0 +1,58 @@
+package db
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDestroy(t *testing.T) {
+	clearDir()
+
+	db, err := Open(testdbPath, opt)
+	assert.Nil(t, err)
+	db.Set([]byte("hello"), []byte("world"))
+	db.Close()
+
+	err = Destroy(testdbPath, opt)
+	assert.Nil(t, err)
+	_, err = os.Stat(testdbPath)
+	assert.True(t, os.IsNotExist(err))
+
+	// destroying a missing database is a no-op
+	assert.Nil(t, Destroy(testdbPath, opt))
+}
+
+func TestDestroyKeepsForeignFiles(t *testing.T) {
+	clearDir()
+
+	db, err := Open(testdbPath, opt)
+	assert.Nil(t, err)
+	db.Close()
+
+	foreign := filepath.Join(testdbPath, "notes.txt")
+	err = os.WriteFile(foreign, []byte("keep me"), 0644)
+	assert.Nil(t, err)
+
+	err = Destroy(testdbPath, opt)
+	assert.Nil(t, err)
+
+	entries, err := os.ReadDir(testdbPath)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, "notes.txt", entries[0].Name())
+}
+
+func TestDestroyLocked(t *testing.T) {
+	clearDir()
+
+	db, err := Open(testdbPath, opt)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	err = Destroy(testdbPath, opt)
+	assert.Equal(t, LockErr, err)
+	_, err = os.Stat(dbFilename(testdbPath, fileTypeCurrent, 0))
+	assert.Nil(t, err)
+}
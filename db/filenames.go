@@ -3,6 +3,8 @@ package db
 import (
 	"fmt"
 	"path/filepath"
+	"strconv"
+	"strings"
 )
 
 type fileType int
@@ -13,6 +15,9 @@ const (
 	fileTypeLock
 	fileTypeCurrent
 	fileTypeTable
+	fileTypeInfoLog
+	fileTypeOldInfoLog
+	fileTypeTemp
 )
 
 func dbFilename(dirname string, fileType fileType, fileNum int) string {
@@ -23,10 +28,68 @@ func dbFilename(dirname string, fileType fileType, fileNum int) string {
 		return filepath.Join(dirname, fmt.Sprintf("%06d.log", fileNum))
 	case fileTypeTable:
 		return filepath.Join(dirname, fmt.Sprintf("%06d.ldb", fileNum))
+	case fileTypeTemp:
+		return filepath.Join(dirname, fmt.Sprintf("%06d.dbtmp", fileNum))
 	case fileTypeManifest:
 		return filepath.Join(dirname, fmt.Sprintf("MANIFEST-%06d", fileNum))
 	case fileTypeCurrent:
 		return filepath.Join(dirname, "CURRENT")
+	case fileTypeInfoLog:
+		return filepath.Join(dirname, "LOG")
+	case fileTypeOldInfoLog:
+		return filepath.Join(dirname, "LOG.old")
 	}
 	panic("unreachable")
 }
+
+// parseDBFilename is the inverse of dbFilename. It returns the type and number of the file
+// with the given base name, or false if the name is not used by the database
+func parseDBFilename(name string) (fileType, int, bool) {
+	switch name {
+	case "LOCK":
+		return fileTypeLock, 0, true
+	case "CURRENT":
+		return fileTypeCurrent, 0, true
+	case "LOG":
+		return fileTypeInfoLog, 0, true
+	case "LOG.old":
+		return fileTypeOldInfoLog, 0, true
+	}
+	if strings.HasPrefix(name, "MANIFEST-") {
+		num, ok := parseFileNum(strings.TrimPrefix(name, "MANIFEST-"))
+		return fileTypeManifest, num, ok
+	}
+	i := strings.IndexByte(name, '.')
+	if i < 0 {
+		return 0, 0, false
+	}
+	num, ok := parseFileNum(name[:i])
+	if !ok {
+		return 0, 0, false
+	}
+	switch name[i:] {
+	case ".log":
+		return fileTypeLog, num, true
+	case ".ldb":
+		return fileTypeTable, num, true
+	case ".dbtmp":
+		return fileTypeTemp, num, true
+	}
+	return 0, 0, false
+}
+
+func parseFileNum(s string) (int, bool) {
+	if s == "" {
+		return 0, false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+	}
+	num, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, false
+	}
+	return num, true
+}
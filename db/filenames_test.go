@@ -0,0 +1,27 @@
+package db
+
+import (
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseDBFilename(t *testing.T) {
+	for _, ft := range []fileType{fileTypeLog, fileTypeManifest, fileTypeLock, fileTypeCurrent,
+		fileTypeTable, fileTypeInfoLog, fileTypeOldInfoLog, fileTypeTemp} {
+		num := 0
+		if ft == fileTypeLog || ft == fileTypeManifest || ft == fileTypeTable || ft == fileTypeTemp {
+			num = 123
+		}
+		name := filepath.Base(dbFilename("dir", ft, num))
+		parsedType, parsedNum, ok := parseDBFilename(name)
+		assert.True(t, ok, name)
+		assert.Equal(t, ft, parsedType, name)
+		assert.Equal(t, num, parsedNum, name)
+	}
+
+	for _, name := range []string{"", "foo", "000001.txt", "MANIFEST-", "MANIFEST-12a", ".log", "-1.ldb", "LOCK2"} {
+		_, _, ok := parseDBFilename(name)
+		assert.False(t, ok, name)
+	}
+}
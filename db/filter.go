@@ -0,0 +1,81 @@
+package db
+
+import (
+	"leveldb_go/util"
+	"time"
+)
+
+// FilterDecision is what a CompactionFilter does with a value
+type FilterDecision int
+
+const (
+	FilterKeep FilterDecision = iota
+	FilterRemove
+	// FilterChangeValue replaces the value with the one returned by the filter
+	FilterChangeValue
+)
+
+// CompactionFilter drops or rewrites values as flushes and compactions write them out, e.g.
+// to collect expired sessions. It sees the newest value of every key, but not merge
+// operands without a known value or entries covered by a deletion
+type CompactionFilter interface {
+	// Filter is called with each value written to level. bottommost is set if no deeper
+	// level, or older level 0 table for a flush, holds keys in the range being written
+	Filter(level int, key, value []byte, bottommost bool) (FilterDecision, []byte)
+}
+
+// entryFilter returns the entry to write in place of a value, false to drop it
+type entryFilter func(key util.IKey, value []byte) (util.IKey, []byte, bool)
+
+// newEntryFilter applies Opt.CompactionFilter to the values written to level, it is nil
+// without one. older reports whether a table older than the output may hold a key, the
+// removed values of those keys become deletions so that older values stay hidden
+func (db *DB) newEntryFilter(level int, bottommost bool, older func(key []byte) bool) entryFilter {
+	f := db.opt.CompactionFilter
+	if f == nil {
+		return nil
+	}
+	return func(key util.IKey, value []byte) (util.IKey, []byte, bool) {
+		ttl := key.KeyType() == util.IKeyTypeSetWithTTL
+		expiry, userValue := int64(0), value
+		if ttl {
+			expiry, userValue = splitExpiry(value)
+		}
+		decision, newValue := f.Filter(level, key.Key(), userValue, bottommost)
+		switch decision {
+		case FilterRemove:
+			if !older(key.Key()) {
+				return nil, nil, false
+			}
+			return util.CreateIKey(key.Key(), util.IKeyTypeDelete, key.SeqNum()), nil, true
+		case FilterChangeValue:
+			if ttl {
+				// the expiry stays
+				newValue = expiringValue(newValue, time.Unix(0, expiry))
+			}
+			return key, newValue, true
+		}
+		return key, value, true
+	}
+}
+
+// flushFilter returns the filter of the values flushed from mem into level 0 on top of
+// version. Every table of version is older than mem
+func (db *DB) flushFilter(version *Version, mem *memTable) entryFilter {
+	if db.opt.CompactionFilter == nil {
+		return nil
+	}
+	var minKey, maxKey []byte
+	it := mem.NewIterator()
+	for it.Next() == nil {
+		key := util.IKey(it.Key()).Key()
+		if minKey == nil {
+			minKey = append([]byte{}, key...)
+		}
+		maxKey = append(maxKey[:0], key...)
+	}
+	bottommost := minKey == nil || !db.inDeeperLevel(version, -1, minKey, maxKey)
+	return db.newEntryFilter(0, bottommost, func(key []byte) bool {
+		return db.inDeeperLevel(version, -1, key, key)
+	})
+}
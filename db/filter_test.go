@@ -0,0 +1,107 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// testFilter removes the keys starting with "expired" and upper cases the values of the
+// keys starting with "upper". It records the level and bottommost flag of its calls
+type testFilter struct {
+	mu    sync.Mutex
+	calls map[string][2]interface{}
+}
+
+func (f *testFilter) Filter(level int, key, value []byte, bottommost bool) (FilterDecision, []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.calls == nil {
+		f.calls = make(map[string][2]interface{})
+	}
+	f.calls[string(key)] = [2]interface{}{level, bottommost}
+	switch {
+	case bytes.HasPrefix(key, []byte("expired")):
+		return FilterRemove, nil
+	case bytes.HasPrefix(key, []byte("upper")):
+		return FilterChangeValue, bytes.ToUpper(value)
+	}
+	return FilterKeep, nil
+}
+
+func (f *testFilter) call(key string) [2]interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[key]
+}
+
+func TestCompactionFilter(t *testing.T) {
+	clearDir()
+	filter := &testFilter{}
+	filterOpt := withoutCompaction(Opt{CompactionFilter: filter})
+	db, err := Open(testdbPath, filterOpt)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, db.Set([]byte(fmt.Sprint("expired", i)), []byte("value")))
+		assert.Nil(t, db.Set([]byte(fmt.Sprint("upper", i)), []byte("value")))
+		assert.Nil(t, db.Set([]byte(fmt.Sprint("key", i)), []byte("value")))
+	}
+	// older versions of a filtered key are dropped with it
+	assert.Nil(t, db.Set([]byte("expired0"), []byte("newer")))
+	db.mu.Lock()
+	assert.Nil(t, db.flushMemTable())
+	db.mu.Unlock()
+
+	// nothing older holds the keys, the flush drops the removed ones
+	assert.Equal(t, [2]interface{}{0, true}, filter.call("expired0"))
+	assert.Equal(t, 1, db.Stats().LevelFiles[0])
+	assert.Equal(t, 20, len(tableEntries(t, db, 0)))
+	for i := 0; i < 10; i++ {
+		_, err := db.Get([]byte(fmt.Sprint("expired", i)))
+		assert.NotNil(t, err)
+		v, err := db.Get([]byte(fmt.Sprint("upper", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, "VALUE", string(v))
+		v, err = db.Get([]byte(fmt.Sprint("key", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, "value", string(v))
+	}
+
+	db.mu.Lock()
+	assert.Nil(t, db.compactLevel0())
+	db.mu.Unlock()
+	assert.Equal(t, [2]interface{}{1, true}, filter.call("key0"))
+	assert.Equal(t, 20, len(tableEntries(t, db, 1)))
+}
+
+func TestCompactionFilterKeepsOlderValuesHidden(t *testing.T) {
+	clearDir()
+	filter := &testFilter{}
+	filterOpt := withoutCompaction(Opt{CompactionFilter: filter})
+	db, err := Open(testdbPath, filterOpt)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	ext := filepath.Join("testdb", "ext.sst")
+	writeSST(t, ext, []testKV{{"expired", "old"}})
+	assert.Nil(t, db.IngestExternalFiles([]string{ext}))
+	assert.Nil(t, db.Set([]byte("expired"), []byte("new")))
+	assert.Nil(t, db.Set([]byte("key"), []byte("value")))
+	db.mu.Lock()
+	assert.Nil(t, db.flushMemTable())
+	assert.Nil(t, db.compactLevel0())
+	db.mu.Unlock()
+
+	// the ingested table is deeper, so the removed value becomes a deletion
+	assert.Equal(t, [2]interface{}{1, false}, filter.call("key"))
+	_, err = db.Get([]byte("expired"))
+	assert.NotNil(t, err)
+	v, err := db.Get([]byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, "value", string(v))
+}
@@ -0,0 +1,254 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"leveldb_go/table"
+	"leveldb_go/util"
+	"leveldb_go/vfs"
+	"sort"
+)
+
+// KeyOrderErr is returned when keys are not in strictly increasing order
+var KeyOrderErr = errors.New("keys are not in strictly increasing order")
+
+// SSTWriter builds a sorted table outside of a live DB, to be added to one with
+// DB.IngestExternalFiles. Keys must be set in strictly increasing order
+type SSTWriter struct {
+	f       vfs.File
+	w       *table.Writer
+	ucmp    util.Comparator
+	lastKey []byte
+}
+
+// NewSSTWriter creates filename on opt.FS and returns a writer for it
+func NewSSTWriter(filename string, opt Opt) (*SSTWriter, error) {
+	f, err := opt.fs().Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	w := table.NewWriter(f, table.TableMaxBlockSize, util.IKeyStringCmp)
+	// ingested files are rewritten with the compression of the level they end up at
+	w.SetCompressor(table.NoCompression)
+	return &SSTWriter{
+		f:    f,
+		w:    w,
+		ucmp: &util.StringComparator{},
+	}, nil
+}
+
+func (w *SSTWriter) Set(key, value []byte) error {
+	if w.lastKey != nil && w.ucmp.Compare(key, w.lastKey) <= 0 {
+		return KeyOrderErr
+	}
+	w.lastKey = append(w.lastKey[:0], key...)
+	// the sequence number is assigned when the file is ingested
+	return w.w.Add(util.CreateIKey(key, util.IKeyTypeSet, 0), value)
+}
+
+// Finish writes the index and footer, syncs the file and closes it
+func (w *SSTWriter) Finish() error {
+	err := w.w.Close()
+	if err != nil {
+		w.f.Close()
+		return err
+	}
+	err = w.f.Sync()
+	if err != nil {
+		w.f.Close()
+		return err
+	}
+	return w.f.Close()
+}
+
+type externalFile struct {
+	path           string
+	minKey, maxKey []byte // user keys
+}
+
+// IngestExternalFiles adds tables built with SSTWriter to the database without going
+// through the memtable. The files are read from opt.FS and left in place.
+// Every file must be non-empty, sorted and must not overlap the other files. All ingested
+// keys get one new sequence number, so they shadow older values of the same keys
+func (db *DB) IngestExternalFiles(paths []string) error {
+	return db.exclusive(func() error {
+		return db.ingestExternalFiles(paths)
+	})
+}
+
+func (db *DB) ingestExternalFiles(paths []string) error {
+	if db.readOnly {
+		return ReadOnlyErr
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+
+	files := make([]externalFile, 0, len(paths))
+	for _, path := range paths {
+		ext, err := db.scanExternalFile(path)
+		if err != nil {
+			return err
+		}
+		files = append(files, ext)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return db.ucmp.Compare(files[i].minKey, files[j].minKey) < 0
+	})
+	for i := 1; i < len(files); i++ {
+		if db.ucmp.Compare(files[i].minKey, files[i-1].maxKey) <= 0 {
+			return fmt.Errorf("ingest: %s overlaps %s", files[i].path, files[i-1].path)
+		}
+	}
+
+	// the memtable may hold older versions of ingested keys, which would shadow them
+	err := db.flushMemTable()
+	if err != nil {
+		return err
+	}
+	// a running compaction could write level 1 tables overlapping the ingested ones
+	err = db.waitForCompactions()
+	if err != nil {
+		return err
+	}
+
+	seq := db.nextSeqNum()
+	version := db.versionSet.currentVersion
+	var added []tableFile
+	for _, ext := range files {
+		level := db.ingestLevel(version, ext.minKey, ext.maxKey)
+		meta, err := db.copyExternalFile(ext.path, db.versionSet.newFileNum(), level, seq)
+		if err != nil {
+			db.removeTables(added)
+			return err
+		}
+		added = append(added, meta)
+	}
+
+	err = db.logAndApply(NewVersionEdit(seq, added, nil))
+	if err != nil {
+		db.removeTables(added)
+		return err
+	}
+	db.maybeScheduleCompaction()
+	return nil
+}
+
+// scanExternalFile checks that the table at path is sorted and returns its key range
+func (db *DB) scanExternalFile(path string) (externalFile, error) {
+	ext := externalFile{path: path}
+	err := db.readExternalFile(path, func(key util.IKey, value []byte) error {
+		if len(key) < 8 || key.KeyType() != util.IKeyTypeSet {
+			return fmt.Errorf("ingest: %s: invalid key", path)
+		}
+		if ext.maxKey != nil && db.ucmp.Compare(key.Key(), ext.maxKey) <= 0 {
+			return fmt.Errorf("ingest: %s: %w", path, KeyOrderErr)
+		}
+		if ext.minKey == nil {
+			ext.minKey = append([]byte{}, key.Key()...)
+		}
+		ext.maxKey = append(ext.maxKey[:0], key.Key()...)
+		return nil
+	})
+	if err != nil {
+		return externalFile{}, err
+	}
+	if ext.minKey == nil {
+		return externalFile{}, fmt.Errorf("ingest: %s is empty", path)
+	}
+	return ext, nil
+}
+
+func (db *DB) readExternalFile(path string, fn func(key util.IKey, value []byte) error) error {
+	f, err := db.opt.fs().Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	reader, err := table.NewReader(f, int(stat.Size()), db.cmp)
+	if err != nil {
+		return err
+	}
+	it := reader.Iterator()
+	for {
+		err = it.Next()
+		if err == table.BlockEndErr {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = fn(it.Key(), it.Value())
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// copyExternalFile copies the table at path into the database directory as a table of
+// the given level, rewriting every key with seq
+func (db *DB) copyExternalFile(path string, fileNum int, level int, seq uint64) (tableFile, error) {
+	filename := dbFilename(db.dirname, fileTypeTable, fileNum)
+	f, err := db.fs.Create(filename)
+	if err != nil {
+		return tableFile{}, err
+	}
+	defer f.Close()
+	writer := table.NewWriter(f, table.TableMaxBlockSize, db.cmp)
+	writer.SetCompressor(db.opt.compressor(level))
+
+	var minKey, maxKey util.IKey
+	err = db.readExternalFile(path, func(key util.IKey, value []byte) error {
+		ikey := util.CreateIKey(key.Key(), util.IKeyTypeSet, seq)
+		if minKey == nil {
+			minKey = ikey
+		}
+		maxKey = ikey
+		return writer.Add(ikey, value)
+	})
+	if err == nil {
+		err = writer.Close()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		db.fs.Remove(filename)
+		return tableFile{}, err
+	}
+
+	return tableFile{
+		fileNum: fileNum,
+		minKey:  minKey,
+		maxKey:  maxKey,
+		level:   level,
+		size:    writer.Len(),
+		lastSeq: seq,
+	}, nil
+}
+
+// ingestLevel returns the deepest level a table holding [minKey, maxKey] can be placed
+// at, such that neither that level nor any level above it overlaps the range
+func (db *DB) ingestLevel(version *Version, minKey, maxKey []byte) int {
+	for level := 0; level < numLevels; level++ {
+		for _, f := range version.files[level] {
+			if db.overlaps(f, minKey, maxKey) {
+				if level == 0 {
+					return 0
+				}
+				return level - 1
+			}
+		}
+	}
+	return numLevels - 1
+}
+
+func (db *DB) removeTables(files []tableFile) {
+	for _, f := range files {
+		db.fs.Remove(dbFilename(db.dirname, fileTypeTable, f.fileNum))
+	}
+}
@@ -0,0 +1,95 @@
+package db
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"testing"
+)
+
+func writeSST(t *testing.T, path string, kvs []testKV) {
+	w, err := NewSSTWriter(path, opt)
+	assert.Nil(t, err)
+	for _, kv := range kvs {
+		assert.Nil(t, w.Set([]byte(kv.key), []byte(kv.value)))
+	}
+	assert.Nil(t, w.Finish())
+}
+
+func TestIngestExternalFiles(t *testing.T) {
+	clearDir()
+
+	db, err := Open(testdbPath, opt)
+	assert.Nil(t, err)
+	db.Set([]byte("a05"), []byte("old"))
+	db.Set([]byte("a60"), []byte("untouched"))
+
+	var kvs1, kvs2 []testKV
+	for i := 0; i < 50; i++ {
+		kvs1 = append(kvs1, testKV{fmt.Sprintf("a%02d", i), fmt.Sprint("value", i)})
+		kvs2 = append(kvs2, testKV{fmt.Sprintf("b%02d", i), fmt.Sprint("value", i)})
+	}
+	ext1 := filepath.Join("testdb", "ext1.sst")
+	ext2 := filepath.Join("testdb", "ext2.sst")
+	writeSST(t, ext1, kvs1)
+	writeSST(t, ext2, kvs2)
+
+	err = db.IngestExternalFiles([]string{ext2, ext1})
+	assert.Nil(t, err)
+	// the b file overlaps nothing, so it goes to the last level
+	version := db.versionSet.currentVersion
+	assert.Equal(t, 1, len(version.files[numLevels-1]))
+
+	v, err := db.Get([]byte("a05"))
+	assert.Nil(t, err)
+	assert.Equal(t, "value5", string(v))
+
+	// later writes shadow ingested keys
+	db.Set([]byte("b10"), []byte("new"))
+	db.Close()
+
+	db, err = Open(testdbPath, opt)
+	assert.Nil(t, err)
+	defer db.Close()
+	for _, kv := range append(kvs1, kvs2...) {
+		v, err := db.Get([]byte(kv.key))
+		assert.Nil(t, err)
+		if kv.key == "b10" {
+			assert.Equal(t, "new", string(v))
+		} else {
+			assert.Equal(t, kv.value, string(v))
+		}
+	}
+	v, err = db.Get([]byte("a60"))
+	assert.Nil(t, err)
+	assert.Equal(t, "untouched", string(v))
+}
+
+func TestIngestRejectsBadFiles(t *testing.T) {
+	clearDir()
+
+	db, err := Open(testdbPath, opt)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	w, err := NewSSTWriter(filepath.Join("testdb", "bad.sst"), opt)
+	assert.Nil(t, err)
+	assert.Nil(t, w.Set([]byte("b"), []byte("1")))
+	assert.Equal(t, KeyOrderErr, w.Set([]byte("a"), []byte("2")))
+	assert.Nil(t, w.Finish())
+
+	ext1 := filepath.Join("testdb", "ext1.sst")
+	ext2 := filepath.Join("testdb", "ext2.sst")
+	writeSST(t, ext1, []testKV{{"a", "1"}, {"c", "1"}})
+	writeSST(t, ext2, []testKV{{"b", "2"}, {"d", "2"}})
+	err = db.IngestExternalFiles([]string{ext1, ext2})
+	assert.NotNil(t, err)
+
+	empty := filepath.Join("testdb", "empty.sst")
+	writeSST(t, empty, nil)
+	err = db.IngestExternalFiles([]string{empty})
+	assert.NotNil(t, err)
+
+	_, err = db.Get([]byte("a"))
+	assert.NotNil(t, err)
+}
@@ -3,6 +3,7 @@ package db
 import (
 	"errors"
 	"leveldb_go/record"
+	"leveldb_go/vfs"
 	"os"
 	"strconv"
 )
@@ -12,87 +13,132 @@ type manifest struct {
 	writer  *ManifestWriter
 }
 
-func createNewManifest(dirname string, fileNum int) (*ManifestWriter, error) {
-	m, err := os.Create(dbFilename(dirname, fileTypeManifest, fileNum))
+// createNewManifest writes a manifest starting with snapshot and points CURRENT at it
+func createNewManifest(fs vfs.FS, dirname string, fileNum int, snapshot *VersionEdit) (*ManifestWriter, error) {
+	m, err := fs.Create(dbFilename(dirname, fileTypeManifest, fileNum))
 	if err != nil {
 		return nil, err
 	}
-	err = os.WriteFile(dbFilename(dirname, fileTypeCurrent, 0),
-		[]byte(dbFilename(".", fileTypeManifest, fileNum)), 0644)
+	w := NewManifestWriter(record.NewWriter(m))
+	err = w.Append(snapshot)
 	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	err = writeCurrentFile(fs, dirname, fileNum)
+	if err != nil {
+		w.Close()
 		return nil, err
 	}
 
-	return NewManifestWriter(record.NewWriter(m)), nil
+	return w, nil
 }
 
-func openManifest(dirname string) (*manifest, *VersionSet, error) {
-	current, err := os.Open(dbFilename(dirname, fileTypeCurrent, 0))
+// writeCurrentFile atomically points CURRENT at the manifest with the given number.
+// The contents go to a temporary file first so that a crash never leaves CURRENT half written
+func writeCurrentFile(fs vfs.FS, dirname string, fileNum int) error {
+	tmpName := dbFilename(dirname, fileTypeTemp, fileNum)
+	tmp, err := fs.Create(tmpName)
 	if err != nil {
-		return nil, nil, err
+		return err
+	}
+	_, err = tmp.Write([]byte(dbFilename(".", fileTypeManifest, fileNum)))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		tmp.Close()
+		fs.Remove(tmpName)
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	err = fs.Rename(tmpName, dbFilename(dirname, fileTypeCurrent, 0))
+	if err != nil {
+		fs.Remove(tmpName)
+		return err
+	}
+	return fs.SyncDir(dirname)
+}
+
+func readCurrentFile(fs vfs.FS, dirname string) (int, error) {
+	current, err := fs.Open(dbFilename(dirname, fileTypeCurrent, 0))
+	if err != nil {
+		return 0, err
 	}
 	defer current.Close()
 	buf := make([]byte, 20)
 	len, err := current.Read(buf)
 	if err != nil {
-		return nil, nil, err
+		return 0, err
 	}
 	buf = buf[:len]
 	if len != 15 || string(buf[:9]) != "MANIFEST-" {
-		return nil, nil, errors.New("current file corrupted")
+		return 0, errors.New("current file corrupted")
 	}
 	fileNum, err := strconv.Atoi(string(buf[9:]))
 	if err != nil {
-		return nil, nil, err
+		return 0, err
 	}
-	m, err := os.Open(dbFilename(dirname, fileTypeManifest, fileNum))
+	return fileNum, nil
+}
+
+// readVersionSet loads the version set from the manifest named by CURRENT,
+// returning it along with the number of that manifest
+func readVersionSet(fs vfs.FS, dirname string) (*VersionSet, int, error) {
+	fileNum, err := readCurrentFile(fs, dirname)
 	if err != nil {
-		return nil, nil, err
+		return nil, 0, err
+	}
+	m, err := fs.Open(dbFilename(dirname, fileTypeManifest, fileNum))
+	if err != nil {
+		return nil, 0, err
 	}
 	defer m.Close()
 
 	vs, err := ReadManifest(record.NewReader(m))
 	if err != nil {
-		return nil, nil, err
+		return nil, 0, err
 	}
+	vs.markFileNumUsed(fileNum)
+	return vs, fileNum, nil
+}
 
-	w, err := createNewManifest(dirname, fileNum+1)
+func openManifest(fs vfs.FS, dirname string) (*manifest, *VersionSet, error) {
+	vs, fileNum, err := readVersionSet(fs, dirname)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	err = w.Append(vs.AsVersionEdit())
+	newFileNum := vs.newFileNum()
+	w, err := createNewManifest(fs, dirname, newFileNum, vs.AsVersionEdit())
 	if err != nil {
 		return nil, nil, err
 	}
+	// CURRENT no longer points at the old manifest
+	fs.Remove(dbFilename(dirname, fileTypeManifest, fileNum))
 
 	return &manifest{
-		fileNum: fileNum + 1,
+		fileNum: newFileNum,
 		writer:  w,
 	}, vs, nil
 
 }
 
-func initManifest(dirname string) error {
-	current, err := os.Create(dbFilename(dirname, fileTypeCurrent, 0))
-	if err != nil {
-		return err
-	}
-	defer current.Close()
-	m, err := os.Create(dbFilename(dirname, fileTypeManifest, 2))
-	if err != nil {
-		return err
-	}
-	m.Close()
-	_, err = current.Write([]byte(dbFilename(".", fileTypeManifest, 2)))
+func initManifest(fs vfs.FS, dirname string) error {
+	vs := NewVersionSet()
+	fileNum := vs.newFileNum()
+	w, err := createNewManifest(fs, dirname, fileNum, &VersionEdit{nextFileNum: vs.nextFileNum})
 	if err != nil {
 		return err
 	}
-	return nil
+	return w.Close()
 }
 
-func isManifestExist(dirname string) (bool, error) {
-	_, err := os.Stat(dbFilename(dirname, fileTypeCurrent, 0))
+func isManifestExist(fs vfs.FS, dirname string) (bool, error) {
+	_, err := fs.Stat(dbFilename(dirname, fileTypeCurrent, 0))
 	if os.IsNotExist(err) {
 		return false, nil
 	}
@@ -0,0 +1,134 @@
+package db
+
+import (
+	"errors"
+	"io"
+	"leveldb_go/util"
+	"leveldb_go/vfs"
+	"sync"
+)
+
+var MemoryLimitErr = errors.New("in-memory database is full")
+
+// OpenInMemory opens an empty database that lives entirely in memory. It writes no lock,
+// log or manifest, and its tables are kept in an in-memory filesystem, so its contents are
+// lost on Close unless they are written out with SaveTo. opt.FS is only the filesystem
+// SaveTo writes to.
+func OpenInMemory(opt Opt) (*DB, error) {
+	db := &DB{
+		fs:         vfs.NewMem(),
+		dirname:    "",
+		mem:        opt.newMemTable(util.IKeyStringCmp),
+		cmp:        util.IKeyStringCmp,
+		ucmp:       &util.StringComparator{},
+		opt:        opt,
+		versionSet: NewVersionSet(),
+		inMemory:   true,
+	}
+	db.bgCond = sync.NewCond(&db.mu)
+	return db, nil
+}
+
+func (db *DB) checkMemoryLimit(n int) error {
+	if db.opt.MemoryLimit <= 0 {
+		return nil
+	}
+	size := db.mem.ApproximateMemoryUsage() + n
+	if db.imm != nil {
+		size += db.imm.ApproximateMemoryUsage()
+	}
+	for _, files := range db.versionSet.currentVersion.files {
+		for _, f := range files {
+			size += int(f.size)
+		}
+	}
+	if size > db.opt.MemoryLimit {
+		return MemoryLimitErr
+	}
+	return nil
+}
+
+// SaveTo writes the contents of an in-memory database into a new database in dirname
+// that can later be opened with Open. dirname must not already hold a database. It is
+// locked while the files are written, so an Open of dirname meanwhile fails with LockErr.
+func (db *DB) SaveTo(dirname string) error {
+	return db.exclusive(func() error {
+		return db.saveTo(dirname)
+	})
+}
+
+func (db *DB) saveTo(dirname string) error {
+	if !db.inMemory {
+		return errors.New("SaveTo is only supported for in-memory databases")
+	}
+	fs := db.opt.fs()
+	err := fs.MkdirAll(dirname, 0755)
+	if err != nil {
+		return err
+	}
+	flock, err := lockDB(fs, dirname)
+	if err != nil {
+		return err
+	}
+	defer flock.Close()
+	exist, err := isManifestExist(fs, dirname)
+	if err != nil {
+		return err
+	}
+	if exist {
+		return errors.New("a database already exists in " + dirname)
+	}
+
+	err = db.flushMemTable()
+	if err != nil {
+		return err
+	}
+	for _, files := range db.versionSet.currentVersion.files {
+		for _, f := range files {
+			err = copyFile(db.fs, dbFilename(db.dirname, fileTypeTable, f.fileNum),
+				fs, dbFilename(dirname, fileTypeTable, f.fileNum))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// no log is written, so every log number is obsolete
+	ve := db.versionSet.AsVersionEdit()
+	manifestNum := ve.nextFileNum
+	ve.nextFileNum++
+	ve.logNum = ve.nextFileNum
+	w, err := createNewManifest(fs, dirname, manifestNum, ve)
+	if err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// copyFile copies src into a new synced file dst, possibly across filesystems
+func copyFile(srcFS vfs.FS, src string, dstFS vfs.FS, dst string) error {
+	r, err := srcFS.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return writeFile(dstFS, dst, r)
+}
+
+// writeFile copies everything r holds into a new synced file dst
+func writeFile(dstFS vfs.FS, dst string, r io.Reader) error {
+	w, err := dstFS.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	if err == nil {
+		err = w.Sync()
+	}
+	if err != nil {
+		w.Close()
+		dstFS.Remove(dst)
+		return err
+	}
+	return w.Close()
+}
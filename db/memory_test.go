@@ -0,0 +1,117 @@
+package db
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"leveldb_go/vfs"
+	"os"
+	"testing"
+)
+
+func TestInMemory(t *testing.T) {
+	clearDir()
+
+	var testKVs []testKV
+	for i := 0; i < 200; i++ {
+		testKVs = append(testKVs, testKV{
+			fmt.Sprint("key", i),
+			fmt.Sprint("value", i),
+		})
+	}
+
+	db, err := OpenInMemory(Opt{maxMemorySize: 300})
+	assert.Nil(t, err)
+	for _, kv := range testKVs {
+		assert.Nil(t, db.Set([]byte(kv.key), []byte(kv.value)))
+	}
+	for _, kv := range testKVs {
+		v, err := db.Get([]byte(kv.key))
+		assert.Nil(t, err)
+		assert.Equal(t, kv.value, string(v))
+	}
+	_, err = os.Stat(testdbPath)
+	assert.True(t, os.IsNotExist(err))
+
+	err = db.SaveTo(testdbPath)
+	assert.Nil(t, err)
+	// the in-memory database stays usable
+	assert.Nil(t, db.Set([]byte("after"), []byte("save")))
+	assert.Nil(t, db.Close())
+
+	db2, err := Open(testdbPath, opt)
+	assert.Nil(t, err)
+	defer db2.Close()
+	for _, kv := range testKVs {
+		v, err := db2.Get([]byte(kv.key))
+		assert.Nil(t, err)
+		assert.Equal(t, kv.value, string(v))
+	}
+	_, err = db2.Get([]byte("after"))
+	assert.NotNil(t, err)
+	// new tables do not collide with the saved ones
+	for i := 0; i < 20; i++ {
+		db2.Set([]byte(fmt.Sprint("new", i)), []byte("value"))
+	}
+	v, err := db2.Get([]byte("key0"))
+	assert.Nil(t, err)
+	assert.Equal(t, "value0", string(v))
+}
+
+func TestInMemorySaveToExisting(t *testing.T) {
+	clearDir()
+	db, err := Open(testdbPath, opt)
+	assert.Nil(t, err)
+	db.Close()
+
+	mem, err := OpenInMemory(opt)
+	assert.Nil(t, err)
+	mem.Set([]byte("hello"), []byte("world"))
+	assert.NotNil(t, mem.SaveTo(testdbPath))
+}
+
+func TestInMemorySaveToFS(t *testing.T) {
+	clearDir()
+	fs := vfs.NewMem()
+	memOpt := Opt{maxMemorySize: 100, FS: fs}
+
+	mem, err := OpenInMemory(memOpt)
+	assert.Nil(t, err)
+	defer mem.Close()
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, mem.Set([]byte(fmt.Sprint("key", i)), []byte(fmt.Sprint("value", i))))
+	}
+
+	// the target is locked while it is written
+	db, err := Open(testdbPath, memOpt)
+	assert.Nil(t, err)
+	assert.Equal(t, LockErr, mem.SaveTo(testdbPath))
+	db.Close()
+
+	savePath := "testdb/saved"
+	assert.Nil(t, mem.SaveTo(savePath))
+	_, err = os.Stat(savePath)
+	assert.True(t, os.IsNotExist(err))
+	db, err = Open(savePath, memOpt)
+	assert.Nil(t, err)
+	defer db.Close()
+	for i := 0; i < 20; i++ {
+		v, err := db.Get([]byte(fmt.Sprint("key", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprint("value", i), string(v))
+	}
+}
+
+func TestInMemoryLimit(t *testing.T) {
+	db, err := OpenInMemory(Opt{maxMemorySize: 100, MemoryLimit: 1000})
+	assert.Nil(t, err)
+	defer db.Close()
+
+	var err2 error
+	for i := 0; i < 1000 && err2 == nil; i++ {
+		err2 = db.Set([]byte(fmt.Sprint("key", i)), []byte(fmt.Sprint("value", i)))
+	}
+	assert.Equal(t, MemoryLimitErr, err2)
+	v, err := db.Get([]byte("key0"))
+	assert.Nil(t, err)
+	assert.Equal(t, "value0", string(v))
+}
@@ -0,0 +1,154 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"leveldb_go/memdb"
+	"leveldb_go/util"
+)
+
+// NoMergeOperatorErr is returned by Merge, and by reads of merged keys, when Opt.MergeOperator is nil
+var NoMergeOperatorErr = errors.New("no merge operator")
+
+// MergeOperator combines the operands written by DB.Merge with the value they apply to,
+// e.g. to add to a counter or append to a list without reading it first
+type MergeOperator interface {
+	// FullMerge applies operands, oldest first, to existing, which is nil if the key has
+	// no value
+	FullMerge(key, existing []byte, operands [][]byte) ([]byte, error)
+	// PartialMerge combines operands, oldest first, into a single operand that FullMerge
+	// applies like the sequence. It returns false if they can only be applied to a value
+	PartialMerge(key []byte, operands [][]byte) ([]byte, bool)
+}
+
+// Merge adds operand to the value of key with Opt.MergeOperator. The value is not read,
+// operands are combined by reads and compactions
+func (db *DB) Merge(key, operand []byte) error {
+	if db.opt.MergeOperator == nil {
+		return NoMergeOperatorErr
+	}
+	b := NewWriteBatch()
+	b.Merge(key, operand)
+	return db.Write(b)
+}
+
+// lookup collects the entries of a key from the newest source to the oldest, until one of
+// them settles the value: a Set, a deletion, or an entry older than a range tombstone
+// covering the key. Merge operands above it are kept
+type lookup struct {
+	ikey util.IKey
+	// values point into mapped tables, they have to be copied
+	copyValues bool
+
+	// values with a TTL that expired at now, in nanoseconds since the epoch, are absent
+	now int64
+
+	tombSeq  uint64
+	operands [][]byte // newest first
+	done     bool
+	found    bool
+	value    []byte
+}
+
+func (l *lookup) addTombstones(ucmp util.Comparator, tombstones []rangeTombstone) {
+	if s := coveringSeq(ucmp, tombstones, l.ikey.Key(), l.ikey.SeqNum()); s > l.tombSeq {
+		l.tombSeq = s
+	}
+}
+
+// search adds the entries of the key in it, newest first, and reports whether the value
+// is settled
+func (l *lookup) search(it memdb.Iterator) bool {
+	for ok := it.Seek(l.ikey); ok && !l.done; ok = it.Next() == nil {
+		k := util.IKey(it.Key())
+		if len(k) < 8 || !bytes.Equal(k.Key(), l.ikey.Key()) {
+			break
+		}
+		l.add(k, it.Value())
+	}
+	return l.done
+}
+
+func (l *lookup) add(k util.IKey, value []byte) {
+	if l.copyValues {
+		value = append([]byte{}, value...)
+	}
+	switch {
+	case k.SeqNum() < l.tombSeq:
+		l.done = true
+	case k.KeyType() == util.IKeyTypeMerge:
+		l.operands = append(l.operands, value)
+	case k.KeyType() == util.IKeyTypeSet:
+		l.done, l.found, l.value = true, true, value
+	case k.KeyType() == util.IKeyTypeSetWithTTL:
+		l.done = true
+		if !expired(value, l.now) {
+			_, l.value = splitExpiry(value)
+			l.found = true
+		}
+	default:
+		l.done = true
+	}
+}
+
+// result returns the value of the key, with the merge operands applied
+func (l *lookup) result(op MergeOperator) ([]byte, error) {
+	if len(l.operands) == 0 {
+		if !l.found {
+			return nil, errors.New("not found")
+		}
+		return l.value, nil
+	}
+	if op == nil {
+		return nil, NoMergeOperatorErr
+	}
+	return op.FullMerge(l.ikey.Key(), l.value, reverseOperands(l.operands))
+}
+
+// reverseOperands puts operands collected newest first in the order MergeOperator
+// expects them
+func reverseOperands(operands [][]byte) [][]byte {
+	for i, j := 0, len(operands)-1; i < j; i, j = i+1, j-1 {
+		operands[i], operands[j] = operands[j], operands[i]
+	}
+	return operands
+}
+
+// mergeEntry is a merge operand read by a compaction, or the entry it writes
+type mergeEntry struct {
+	ikey  util.IKey
+	value []byte
+}
+
+// fullMerge applies operands, newest first, to base. The result is a Set with the sequence
+// number of the newest operand
+func fullMerge(op MergeOperator, operands []mergeEntry, base []byte) (mergeEntry, error) {
+	newest := operands[0].ikey
+	v, err := op.FullMerge(newest.Key(), base, operandValues(operands))
+	if err != nil {
+		return mergeEntry{}, err
+	}
+	return mergeEntry{util.CreateIKey(newest.Key(), util.IKeyTypeSet, newest.SeqNum()), v}, nil
+}
+
+// partialMerge combines operands, newest first, into one if op can. Long chains are cut
+// this way although their value is not known yet
+func partialMerge(op MergeOperator, operands []mergeEntry) []mergeEntry {
+	if len(operands) < 2 {
+		return operands
+	}
+	newest := operands[0].ikey
+	v, ok := op.PartialMerge(newest.Key(), operandValues(operands))
+	if !ok {
+		return operands
+	}
+	return []mergeEntry{{util.CreateIKey(newest.Key(), util.IKeyTypeMerge, newest.SeqNum()), v}}
+}
+
+func operandValues(operands []mergeEntry) [][]byte {
+	values := make([][]byte, len(operands))
+	for i, o := range operands {
+		values[i] = o.value
+	}
+	return reverseOperands(values)
+}
@@ -0,0 +1,170 @@
+package db
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"leveldb_go/table"
+	"leveldb_go/util"
+	"path/filepath"
+	"testing"
+)
+
+// counter adds little endian uint64 operands to the value
+type counter struct{}
+
+func (counter) FullMerge(key, existing []byte, operands [][]byte) ([]byte, error) {
+	var n uint64
+	if existing != nil {
+		n = binary.LittleEndian.Uint64(existing)
+	}
+	for _, o := range operands {
+		n += binary.LittleEndian.Uint64(o)
+	}
+	return binary.LittleEndian.AppendUint64(nil, n), nil
+}
+
+func (c counter) PartialMerge(key []byte, operands [][]byte) ([]byte, bool) {
+	v, _ := c.FullMerge(key, nil, operands)
+	return v, true
+}
+
+// appender appends operands to the value, it has no partial merge
+type appender struct{}
+
+func (appender) FullMerge(key, existing []byte, operands [][]byte) ([]byte, error) {
+	v := append([]byte{}, existing...)
+	for _, o := range operands {
+		v = append(v, o...)
+	}
+	return v, nil
+}
+
+func (appender) PartialMerge(key []byte, operands [][]byte) ([]byte, bool) {
+	return nil, false
+}
+
+func add(t *testing.T, db *DB, key string, n uint64) {
+	assert.Nil(t, db.Merge([]byte(key), binary.LittleEndian.AppendUint64(nil, n)))
+}
+
+func count(t *testing.T, db *DB, key string) uint64 {
+	v, err := db.Get([]byte(key))
+	assert.Nil(t, err)
+	if len(v) != 8 {
+		t.Fatalf("invalid counter %q", v)
+	}
+	return binary.LittleEndian.Uint64(v)
+}
+
+// tableEntries returns the keys of the entries in the tables of a level
+func tableEntries(t *testing.T, db *DB, level int) []util.IKey {
+	var keys []util.IKey
+	for _, f := range db.versionSet.currentVersion.files[level] {
+		file, err := db.fs.Open(dbFilename(db.dirname, fileTypeTable, f.fileNum))
+		assert.Nil(t, err)
+		stat, err := file.Stat()
+		assert.Nil(t, err)
+		r, err := table.NewReader(file, int(stat.Size()), db.cmp)
+		assert.Nil(t, err)
+		for it := r.Iterator(); it.Next() == nil; {
+			keys = append(keys, append(util.IKey{}, it.Key()...))
+		}
+		file.Close()
+	}
+	return keys
+}
+
+func TestMerge(t *testing.T) {
+	clearDir()
+	db, err := Open(testdbPath, opt)
+	assert.Nil(t, err)
+	assert.Equal(t, NoMergeOperatorErr, db.Merge([]byte("key"), []byte("1")))
+	assert.Nil(t, db.Close())
+
+	mergeOpt := withoutCompaction(opt)
+	mergeOpt.MergeOperator = counter{}
+	db, err = Open(testdbPath, mergeOpt)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Set([]byte("base"), binary.LittleEndian.AppendUint64(nil, 100)))
+	// the small memtable spreads the operands over several tables
+	for i := 0; i < 10; i++ {
+		add(t, db, "base", 1)
+		add(t, db, "new", 2)
+		add(t, db, "deleted", 3)
+	}
+	assert.True(t, db.Stats().LevelFiles[0] > 1)
+	assert.Equal(t, uint64(110), count(t, db, "base"))
+	assert.Equal(t, uint64(20), count(t, db, "new"))
+
+	// a range tombstone hides the operands below it
+	assert.Nil(t, db.DeleteRange([]byte("deleted"), []byte("deleted\x00")))
+	_, err = db.Get([]byte("deleted"))
+	assert.NotNil(t, err)
+	add(t, db, "deleted", 5)
+	assert.Equal(t, uint64(5), count(t, db, "deleted"))
+	assert.Nil(t, db.Close())
+
+	db, err = Open(testdbPath, mergeOpt)
+	assert.Nil(t, err)
+	defer db.Close()
+	assert.Equal(t, uint64(110), count(t, db, "base"))
+	assert.Equal(t, uint64(20), count(t, db, "new"))
+	assert.Equal(t, uint64(5), count(t, db, "deleted"))
+
+	// nothing is below level 1, so the compaction turns the operands into values
+	db.mu.Lock()
+	assert.Nil(t, db.flushMemTable())
+	assert.Nil(t, db.compactLevel0())
+	db.mu.Unlock()
+	entries := tableEntries(t, db, 1)
+	assert.Equal(t, 3, len(entries))
+	for _, k := range entries {
+		assert.Equal(t, util.IKeyTypeSet, k.KeyType())
+	}
+	assert.Equal(t, uint64(110), count(t, db, "base"))
+	assert.Equal(t, uint64(20), count(t, db, "new"))
+	assert.Equal(t, uint64(5), count(t, db, "deleted"))
+}
+
+func TestMergePartialCompaction(t *testing.T) {
+	for _, op := range []MergeOperator{counter{}, appender{}} {
+		clearDir()
+		mergeOpt := withoutCompaction(opt)
+		mergeOpt.MergeOperator = op
+		db, err := Open(testdbPath, mergeOpt)
+		assert.Nil(t, err)
+
+		// the base value is ingested into the last level
+		base := binary.LittleEndian.AppendUint64(nil, 100)
+		ext := filepath.Join("testdb", "ext.sst")
+		writeSST(t, ext, []testKV{{"key", string(base)}})
+		assert.Nil(t, db.IngestExternalFiles([]string{ext}))
+		for i := 0; i < 10; i++ {
+			assert.Nil(t, db.Merge([]byte("key"), binary.LittleEndian.AppendUint64(nil, 1)))
+			assert.Nil(t, db.Set([]byte(fmt.Sprint("filler", i)), make([]byte, 50)))
+		}
+		db.mu.Lock()
+		assert.Nil(t, db.flushMemTable())
+		assert.Nil(t, db.compactLevel0())
+		db.mu.Unlock()
+
+		var operands int
+		for _, k := range tableEntries(t, db, 1) {
+			if k.KeyType() == util.IKeyTypeMerge {
+				operands++
+			}
+		}
+		v, err := db.Get([]byte("key"))
+		assert.Nil(t, err)
+		if _, ok := op.(counter); ok {
+			// the chain is combined into one operand
+			assert.Equal(t, 1, operands)
+			assert.Equal(t, uint64(110), binary.LittleEndian.Uint64(v))
+		} else {
+			assert.Equal(t, 10, operands)
+			assert.Equal(t, 8*11, len(v))
+		}
+		assert.Nil(t, db.Close())
+	}
+}
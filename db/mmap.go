@@ -0,0 +1,127 @@
+package db
+
+import (
+	"container/list"
+	"leveldb_go/table"
+	"leveldb_go/vfs"
+)
+
+// maxCachedTables bounds the tables past the mmap budget that are kept open
+const maxCachedTables = 100
+
+type mappedTable struct {
+	f vfs.File
+	r *table.Reader
+}
+
+// cachedTable is an open table that did not fit the mmap budget. It is closed once it
+// is evicted and no lookup uses it
+type cachedTable struct {
+	mappedTable
+	fileNum int
+	refs    int
+	evicted bool
+	elem    *list.Element
+}
+
+// lookupMappedTable is lookupTable for databases mapping their tables. Mapped tables stay
+// open until they are removed or the database is closed. The most recently used tables
+// that don't fit the budget are kept open as well, up to maxCachedTables
+func (db *DB) lookupMappedTable(l *lookup, fileNum int) (bool, error) {
+	r, release, err := db.mappedTable(fileNum)
+	if err != nil {
+		return false, err
+	}
+	defer release()
+	// l copies the values, they point into the mapping, which is gone once the table is
+	// unmapped
+	return db.searchTable(r, fileNum, l)
+}
+
+// mappedTable returns the reader of a table, mapping it if the budget allows. release
+// has to be called once the reader is no longer used
+func (db *DB) mappedTable(fileNum int) (r *table.Reader, release func(), err error) {
+	db.mmapMu.Lock()
+	defer db.mmapMu.Unlock()
+	if db.mapped == nil {
+		db.mmapBudget = table.NewMmapBudget(db.opt.MmapBytes)
+		db.mapped = make(map[int]mappedTable)
+		db.cached = make(map[int]*cachedTable)
+		db.cacheLRU = list.New()
+	}
+	if t, ok := db.mapped[fileNum]; ok {
+		return t.r, func() {}, nil
+	}
+	if c, ok := db.cached[fileNum]; ok {
+		c.refs++
+		db.cacheLRU.MoveToFront(c.elem)
+		return c.r, func() { db.releaseTable(c) }, nil
+	}
+
+	f, err := db.fs.Open(dbFilename(db.dirname, fileTypeTable, fileNum))
+	if err != nil {
+		return nil, nil, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	r, err = table.NewMmapReader(f, int(stat.Size()), db.cmp, db.mmapBudget)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if r.Mapped() {
+		db.mapped[fileNum] = mappedTable{f: f, r: r}
+		return r, func() {}, nil
+	}
+	c := &cachedTable{mappedTable: mappedTable{f: f, r: r}, fileNum: fileNum, refs: 1}
+	c.elem = db.cacheLRU.PushFront(c)
+	db.cached[fileNum] = c
+	if db.cacheLRU.Len() > maxCachedTables {
+		db.unmapTable(db.cacheLRU.Back().Value.(*cachedTable).fileNum)
+	}
+	return r, func() { db.releaseTable(c) }, nil
+}
+
+func (db *DB) releaseTable(c *cachedTable) {
+	db.mmapMu.Lock()
+	defer db.mmapMu.Unlock()
+	c.refs--
+	if c.refs == 0 && c.evicted {
+		c.f.Close()
+	}
+}
+
+// unmapTable closes the mapping of a table, or evicts it from the cache of open tables.
+// It has to be called before the table is removed. db.mmapMu must be held
+func (db *DB) unmapTable(fileNum int) {
+	if c, ok := db.cached[fileNum]; ok {
+		db.cacheLRU.Remove(c.elem)
+		delete(db.cached, fileNum)
+		// lookups in flight keep the file open until they are done
+		c.evicted = true
+		if c.refs == 0 {
+			c.f.Close()
+		}
+	}
+	t, ok := db.mapped[fileNum]
+	if !ok {
+		return
+	}
+	t.r.Close()
+	t.f.Close()
+	delete(db.mapped, fileNum)
+}
+
+func (db *DB) unmapTables() {
+	db.mmapMu.Lock()
+	defer db.mmapMu.Unlock()
+	for fileNum := range db.mapped {
+		db.unmapTable(fileNum)
+	}
+	for fileNum := range db.cached {
+		db.unmapTable(fileNum)
+	}
+}
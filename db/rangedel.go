@@ -0,0 +1,149 @@
+package db
+
+import (
+	"errors"
+	"leveldb_go/memdb"
+	"leveldb_go/table"
+	"leveldb_go/util"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// rangeTombstone deletes the entries of the user keys in [start, end) older than seq.
+// Tables store it as the internal key of start with end as the value
+type rangeTombstone struct {
+	start, end []byte
+	seq        uint64
+}
+
+func (t rangeTombstone) ikey() util.IKey {
+	return util.CreateIKey(t.start, util.IKeyTypeRangeDelete, t.seq)
+}
+
+// coveringSeq returns the sequence number of the newest tombstone not newer than readSeq
+// whose range holds key, 0 if there is none. Entries older than it are deleted
+func coveringSeq(ucmp util.Comparator, tombstones []rangeTombstone, key []byte, readSeq uint64) uint64 {
+	var seq uint64
+	for _, t := range tombstones {
+		if t.seq > seq && t.seq <= readSeq && ucmp.Compare(t.start, key) <= 0 && ucmp.Compare(key, t.end) < 0 {
+			seq = t.seq
+		}
+	}
+	return seq
+}
+
+// sortTombstones sorts tombstones in the order of their internal keys
+func sortTombstones(cmp util.Comparator, tombstones []rangeTombstone) {
+	sort.Slice(tombstones, func(i, j int) bool {
+		return cmp.Compare(tombstones[i].ikey(), tombstones[j].ikey()) < 0
+	})
+}
+
+// extendBounds widens the key range of a table to hold the range of t. The end of t is
+// excluded, it is given the largest sequence number so that it sorts before every entry
+// of the end key
+func extendBounds(cmp util.Comparator, minKey, maxKey util.IKey, t rangeTombstone) (util.IKey, util.IKey) {
+	if start := t.ikey(); minKey == nil || cmp.Compare(start, minKey) < 0 {
+		minKey = start
+	}
+	if end := util.CreateIKey(t.end, util.IKeyTypeRangeDelete, util.MaxSeqNum); maxKey == nil || cmp.Compare(end, maxKey) > 0 {
+		maxKey = end
+	}
+	return minKey, maxKey
+}
+
+// memTable is a memdb.MemTable that keeps the range tombstones added to it apart from
+// the point entries
+type memTable struct {
+	memdb.MemTable
+
+	// Add runs in the write leader while Gets read the tombstones
+	mu             sync.RWMutex
+	tombstones     []rangeTombstone
+	tombstoneBytes int
+	// typed is set once the memtable holds merge operands or values with a TTL, which
+	// MemTable.Get would return as plain values
+	typed atomic.Bool
+}
+
+func (m *memTable) Add(ikey util.IKey, value []byte) {
+	if ikey.KeyType() != util.IKeyTypeRangeDelete {
+		if t := ikey.KeyType(); t == util.IKeyTypeMerge || t == util.IKeyTypeSetWithTTL {
+			m.typed.Store(true)
+		}
+		m.MemTable.Add(ikey, value)
+		return
+	}
+	t := rangeTombstone{
+		start: append([]byte{}, ikey.Key()...),
+		end:   append([]byte{}, value...),
+		seq:   ikey.SeqNum(),
+	}
+	m.mu.Lock()
+	m.tombstones = append(m.tombstones, t)
+	m.tombstoneBytes += len(ikey) + len(value)
+	m.mu.Unlock()
+}
+
+func (m *memTable) ApproximateMemoryUsage() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.MemTable.ApproximateMemoryUsage() + m.tombstoneBytes
+}
+
+// rangeTombstones returns the tombstones added so far. Later Adds don't change the result
+func (m *memTable) rangeTombstones() []rangeTombstone {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.tombstones[:len(m.tombstones):len(m.tombstones)]
+}
+
+// tableRangeTombstones returns the range tombstones of a table. Tables don't change, so
+// they are read once
+func (db *DB) tableRangeTombstones(r *table.Reader, fileNum int) ([]rangeTombstone, error) {
+	db.rangeDelMu.Lock()
+	tombstones, ok := db.rangeDels[fileNum]
+	db.rangeDelMu.Unlock()
+	if ok {
+		return tombstones, nil
+	}
+
+	it, err := r.RangeDelIterator()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		err = it.Next()
+		if err == table.BlockEndErr {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		ikey := util.IKey(it.Key())
+		if len(ikey) < 8 {
+			return nil, errors.New("corruption: invalid range tombstone")
+		}
+		// the block may be memory mapped
+		tombstones = append(tombstones, rangeTombstone{
+			start: append([]byte{}, ikey.Key()...),
+			end:   append([]byte{}, it.Value()...),
+			seq:   ikey.SeqNum(),
+		})
+	}
+
+	db.rangeDelMu.Lock()
+	if db.rangeDels == nil {
+		db.rangeDels = make(map[int][]rangeTombstone)
+	}
+	db.rangeDels[fileNum] = tombstones
+	db.rangeDelMu.Unlock()
+	return tombstones, nil
+}
+
+func (db *DB) forgetRangeTombstones(fileNum int) {
+	db.rangeDelMu.Lock()
+	delete(db.rangeDels, fileNum)
+	db.rangeDelMu.Unlock()
+}
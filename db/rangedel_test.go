@@ -0,0 +1,144 @@
+package db
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"leveldb_go/memdb"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// checkDeleted checks that the keys key000 to key099 in one of the ranges [start, end)
+// are deleted and the others hold value<i>
+func checkDeleted(t *testing.T, db *DB, ranges ...[2]int) {
+	for i := 0; i < 100; i++ {
+		deleted := false
+		for _, r := range ranges {
+			deleted = deleted || i >= r[0] && i < r[1]
+		}
+		v, err := db.Get([]byte(fmt.Sprintf("key%03d", i)))
+		if deleted {
+			assert.NotNil(t, err, i)
+		} else {
+			assert.Nil(t, err, i)
+			assert.Equal(t, fmt.Sprint("value", i), string(v))
+		}
+	}
+}
+
+func TestDeleteRange(t *testing.T) {
+	for _, factory := range []memdb.Factory{nil, memdb.NewVector, memdb.HashPrefix(4)} {
+		clearDir()
+		db, err := Open(testdbPath, Opt{MemTable: factory})
+		assert.Nil(t, err)
+		for i := 0; i < 100; i++ {
+			assert.Nil(t, db.Set([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprint("value", i))))
+		}
+		assert.Nil(t, db.DeleteRange([]byte("key020"), []byte("key050")))
+		checkDeleted(t, db, [2]int{20, 50})
+
+		// keys written after the tombstone are visible
+		assert.Nil(t, db.Set([]byte("key030"), []byte("value30")))
+		checkDeleted(t, db, [2]int{20, 30}, [2]int{31, 50})
+		assert.Nil(t, db.DeleteRange([]byte("key025"), []byte("key035")))
+		assert.Nil(t, db.Close())
+
+		// the tombstones are replayed from the log and written to a level 0 table
+		db, err = Open(testdbPath, Opt{MemTable: factory})
+		assert.Nil(t, err)
+		checkDeleted(t, db, [2]int{20, 50})
+		files := db.versionSet.currentVersion.files[0]
+		assert.Equal(t, 1, len(files))
+		assert.Equal(t, uint64(2), tableProperties(t, db, files[0].fileNum).NumRangeDeletions)
+		assert.Nil(t, db.Close())
+	}
+}
+
+func TestDeleteRangeAcrossTables(t *testing.T) {
+	clearDir()
+	db, err := Open(testdbPath, withoutCompaction(opt))
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Set([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprint("value", i))))
+	}
+	assert.True(t, db.Stats().LevelFiles[0] > 1)
+	assert.Nil(t, db.DeleteRange([]byte("key010"), []byte("key090")))
+	checkDeleted(t, db, [2]int{10, 90})
+	assert.Nil(t, db.Set([]byte("key050"), []byte("value50")))
+	assert.Nil(t, db.Close())
+
+	db, err = Open(testdbPath, withoutCompaction(opt))
+	assert.Nil(t, err)
+	defer db.Close()
+	checkDeleted(t, db, [2]int{10, 50}, [2]int{51, 90})
+
+	// nothing deeper holds the range, so the compaction drops the covered entries and the
+	// tombstone
+	db.mu.Lock()
+	assert.Nil(t, db.compactLevel0())
+	db.mu.Unlock()
+	checkDeleted(t, db, [2]int{10, 50}, [2]int{51, 90})
+	var entries uint64
+	for _, f := range db.versionSet.currentVersion.files[1] {
+		props := tableProperties(t, db, f.fileNum)
+		assert.Equal(t, uint64(0), props.NumRangeDeletions)
+		entries += props.NumEntries
+	}
+	assert.Equal(t, uint64(21), entries)
+}
+
+func TestDeleteRangeKeptAboveDeeperLevel(t *testing.T) {
+	clearDir()
+	db, err := Open(testdbPath, withoutCompaction(opt))
+	assert.Nil(t, err)
+	defer db.Close()
+
+	var kvs []testKV
+	for i := 0; i < 100; i++ {
+		kvs = append(kvs, testKV{fmt.Sprintf("key%03d", i), fmt.Sprint("value", i)})
+	}
+	ext := filepath.Join("testdb", "ext.sst")
+	writeSST(t, ext, kvs)
+	assert.Nil(t, db.IngestExternalFiles([]string{ext}))
+	assert.Equal(t, 1, db.Stats().LevelFiles[numLevels-1])
+
+	assert.Nil(t, db.DeleteRange([]byte("key040"), []byte("key060")))
+	db.mu.Lock()
+	assert.Nil(t, db.flushMemTable())
+	assert.Nil(t, db.compactLevel0())
+	db.mu.Unlock()
+
+	// the tombstone still hides the ingested keys
+	checkDeleted(t, db, [2]int{40, 60})
+	files := db.versionSet.currentVersion.files[1]
+	assert.Equal(t, 1, len(files))
+	assert.Equal(t, uint64(1), tableProperties(t, db, files[0].fileNum).NumRangeDeletions)
+	assert.Equal(t, "key040", string(files[0].minKey.Key()))
+	assert.Equal(t, "key060", string(files[0].maxKey.Key()))
+}
+
+func TestGetFailsOnUnreadableTable(t *testing.T) {
+	clearDir()
+	db, err := Open(testdbPath, withoutCompaction(opt))
+	assert.Nil(t, err)
+	defer db.Close()
+
+	ext := filepath.Join("testdb", "ext.sst")
+	writeSST(t, ext, []testKV{{"key", "old"}})
+	assert.Nil(t, db.IngestExternalFiles([]string{ext}))
+	assert.Nil(t, db.DeleteRange([]byte("a"), []byte("z")))
+	db.mu.Lock()
+	assert.Nil(t, db.flushMemTable())
+	db.mu.Unlock()
+
+	// the table holding the tombstone can't be read, the deleted value must not come back
+	files := db.versionSet.currentVersion.files[0]
+	assert.Equal(t, 1, len(files))
+	assert.Nil(t, os.WriteFile(dbFilename(testdbPath, fileTypeTable, files[0].fileNum), []byte("garbage"), 0644))
+	v, err := db.Get([]byte("key"))
+	if assert.NotNil(t, err) {
+		assert.NotEqual(t, "not found", err.Error())
+	}
+	assert.Nil(t, v)
+}
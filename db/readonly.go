@@ -0,0 +1,72 @@
+package db
+
+import (
+	"errors"
+	"leveldb_go/util"
+	"os"
+	"sync"
+)
+
+var ReadOnlyErr = errors.New("database is opened read only")
+
+// openReadOnly opens the database without taking the lock or writing anything.
+// The live logs are replayed into the memtable only, the state is never written back
+func openReadOnly(dirname string, opt Opt) (*DB, error) {
+	var err error
+	// the writer may switch manifests or remove a log during the open, in which case
+	// trying again sees the newer state
+	for attempt := 0; attempt < 3; attempt++ {
+		var db *DB
+		db, err = tryOpenReadOnly(dirname, opt)
+		if !os.IsNotExist(err) {
+			return db, err
+		}
+	}
+	return nil, err
+}
+
+func tryOpenReadOnly(dirname string, opt Opt) (*DB, error) {
+	fs := opt.fs()
+	exist, err := isManifestExist(fs, dirname)
+	if err != nil {
+		return nil, err
+	}
+	if !exist {
+		return nil, &os.PathError{Op: "open", Path: dbFilename(dirname, fileTypeCurrent, 0), Err: os.ErrNotExist}
+	}
+
+	db := &DB{
+		fs:       fs,
+		dirname:  dirname,
+		mem:      opt.newMemTable(util.IKeyStringCmp),
+		cmp:      util.IKeyStringCmp,
+		ucmp:     &util.StringComparator{},
+		opt:      opt,
+		readOnly: true,
+	}
+	db.bgCond = sync.NewCond(&db.mu)
+	// listed before the manifest is read, so that a log the writer flushes meanwhile is
+	// either replayed or has its table in the version, see catchUp
+	logs, err := db.listLogs()
+	if err != nil {
+		return nil, err
+	}
+	db.versionSet, _, err = readVersionSet(fs, dirname)
+	if err != nil {
+		return nil, err
+	}
+	db.seqNum = db.versionSet.currentVersion.seqNum()
+	for _, num := range logs {
+		if num < db.versionSet.logNum {
+			continue
+		}
+		maxSeq, err := replayLog(fs, dbFilename(dirname, fileTypeLog, num), db.mem)
+		if err != nil {
+			return nil, err
+		}
+		if maxSeq > db.seqNum {
+			db.seqNum = maxSeq
+		}
+	}
+	return db, nil
+}
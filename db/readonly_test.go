@@ -0,0 +1,160 @@
+package db
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"leveldb_go/vfs"
+	"os"
+	"strings"
+	"testing"
+)
+
+func listDir(t *testing.T) []string {
+	entries, err := os.ReadDir(testdbPath)
+	assert.Nil(t, err)
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func TestReadOnlyWhileWriterOpen(t *testing.T) {
+	clearDir()
+
+	db, err := Open(testdbPath, Opt{maxMemorySize: 200})
+	assert.Nil(t, err)
+	defer db.Close()
+	for i := 0; i < 50; i++ {
+		db.Set([]byte(fmt.Sprint("key", i)), []byte(fmt.Sprint("value", i)))
+	}
+	// a flush or compaction finishing after the listing would change the directory.
+	// The memtable stays unflushed, so that some records are only in the log
+	waitForCompactions(db)
+
+	before := listDir(t)
+	ro, err := Open(testdbPath, Opt{ReadOnly: true})
+	assert.Nil(t, err)
+	// tables and the records only in the writer's log are both visible
+	for i := 0; i < 50; i++ {
+		v, err := ro.Get([]byte(fmt.Sprint("key", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprint("value", i), string(v))
+	}
+	assert.Equal(t, ReadOnlyErr, ro.Set([]byte("key"), []byte("value")))
+	assert.Nil(t, ro.Close())
+	assert.Equal(t, before, listDir(t))
+
+	// the writer is unaffected
+	assert.Nil(t, db.Set([]byte("more"), []byte("data")))
+}
+
+func TestReadOnlyMissing(t *testing.T) {
+	clearDir()
+	_, err := Open(testdbPath, Opt{ReadOnly: true})
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(testdbPath)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestReadOnlyOpenDuringFlush(t *testing.T) {
+	clearDir()
+
+	db, err := Open(testdbPath, Opt{})
+	assert.Nil(t, err)
+	defer db.Close()
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, db.Set([]byte(fmt.Sprint("key", i)), []byte(fmt.Sprint("value", i))))
+	}
+
+	// the writer flushes its memtable and removes the log while the database is opened
+	fs := &listHookFS{FS: vfs.Default}
+	fs.onList = func() {
+		db.mu.Lock()
+		assert.Nil(t, db.flushMemTable())
+		db.mu.Unlock()
+		waitForCompactions(db)
+	}
+	ro, err := Open(testdbPath, Opt{ReadOnly: true, FS: fs})
+	assert.Nil(t, err)
+	defer ro.Close()
+	assert.Nil(t, fs.onList)
+	for i := 0; i < 10; i++ {
+		v, err := ro.Get([]byte(fmt.Sprint("key", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprint("value", i), string(v))
+	}
+}
+
+// removeLogFS removes a log once, right before it is opened
+type removeLogFS struct {
+	vfs.FS
+	removed bool
+}
+
+func (fs *removeLogFS) Open(name string) (vfs.File, error) {
+	if !fs.removed && strings.HasSuffix(name, ".log") {
+		fs.removed = true
+		os.Remove(name)
+	}
+	return fs.FS.Open(name)
+}
+
+func TestReadOnlyRetriesOpen(t *testing.T) {
+	clearDir()
+
+	db, err := Open(testdbPath, Opt{})
+	assert.Nil(t, err)
+	assert.Nil(t, db.Set([]byte("key"), []byte("value")))
+	assert.Nil(t, db.Close())
+
+	// the log goes away between the listing and its replay, the second try opens the
+	// database without it
+	fs := &removeLogFS{FS: vfs.Default}
+	ro, err := Open(testdbPath, Opt{ReadOnly: true, FS: fs})
+	assert.Nil(t, err)
+	defer ro.Close()
+	assert.True(t, fs.removed)
+	v, err := ro.Get([]byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, "value", string(v))
+}
+
+func TestReadOnlyIsNotRefreshed(t *testing.T) {
+	clearDir()
+
+	db, err := Open(testdbPath, Opt{L0CompactionTrigger: 2})
+	assert.Nil(t, err)
+	defer db.Close()
+	flush := func() {
+		db.mu.Lock()
+		assert.Nil(t, db.flushMemTable())
+		db.mu.Unlock()
+		waitForCompactions(db)
+	}
+	assert.Nil(t, db.Set([]byte("key0"), []byte("value0")))
+	flush()
+
+	ro, err := Open(testdbPath, Opt{ReadOnly: true})
+	assert.Nil(t, err)
+	defer ro.Close()
+
+	// the second table triggers a compaction, which removes the table ro reads key0 from
+	assert.Nil(t, db.Set([]byte("key1"), []byte("value1")))
+	flush()
+	assert.Equal(t, 0, db.Stats().LevelFiles[0])
+	_, err = ro.Get([]byte("key0"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = ro.Get([]byte("key1"))
+	assert.NotNil(t, err)
+
+	// reopening picks up the current state
+	ro2, err := Open(testdbPath, Opt{ReadOnly: true})
+	assert.Nil(t, err)
+	defer ro2.Close()
+	for i := 0; i < 2; i++ {
+		v, err := ro2.Get([]byte(fmt.Sprint("key", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprint("value", i), string(v))
+	}
+}
@@ -0,0 +1,254 @@
+package db
+
+import (
+	"errors"
+	"leveldb_go/table"
+	"leveldb_go/util"
+	"leveldb_go/vfs"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const lostDirname = "lost"
+
+// Repair rebuilds the manifest of the database in dirname from the files that survive in it.
+// Every table is scanned and validated, logs are converted into new tables, and files that
+// cannot be read are moved into the lost/ directory. A fresh manifest and CURRENT are written
+// with all recovered tables placed in level 0.
+func Repair(dirname string, opt Opt) error {
+	fs := opt.fs()
+	flock, err := lockDB(fs, dirname)
+	if err != nil {
+		return err
+	}
+	defer flock.Close()
+
+	r := repairer{
+		fs:      fs,
+		dirname: dirname,
+		cmp:     util.IKeyStringCmp,
+		opt:     opt,
+	}
+	return r.run()
+}
+
+type repairer struct {
+	fs      vfs.FS
+	dirname string
+	cmp     util.Comparator
+	opt     Opt
+
+	logs      []int
+	tables    []int
+	manifests []int
+
+	nextFileNum int
+	maxSeq      uint64
+	recovered   []tableFile
+}
+
+func (r *repairer) run() error {
+	err := r.findFiles()
+	if err != nil {
+		return err
+	}
+	for _, num := range r.logs {
+		err = r.convertLog(num)
+		if err != nil {
+			return err
+		}
+	}
+	for _, num := range r.tables {
+		err = r.scanTable(num)
+		if err != nil {
+			return err
+		}
+	}
+	return r.writeManifest()
+}
+
+func (r *repairer) findFiles() error {
+	names, err := r.fs.List(r.dirname)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		ft, num, ok := parseDBFilename(name)
+		if !ok {
+			continue
+		}
+		switch ft {
+		case fileTypeManifest:
+			r.manifests = append(r.manifests, num)
+		case fileTypeLog:
+			r.logs = append(r.logs, num)
+		case fileTypeTable:
+			r.tables = append(r.tables, num)
+		default:
+			continue
+		}
+		if num >= r.nextFileNum {
+			r.nextFileNum = num + 1
+		}
+	}
+	sort.Ints(r.logs)
+	sort.Ints(r.tables)
+	return nil
+}
+
+func (r *repairer) newFileNum() int {
+	num := r.nextFileNum
+	r.nextFileNum++
+	return num
+}
+
+// convertLog replays every intact batch in the log into a memtable and writes it out as a table.
+// The log is archived afterwards whether or not it could be fully read.
+func (r *repairer) convertLog(num int) error {
+	filename := dbFilename(r.dirname, fileTypeLog, num)
+	mem := r.opt.newMemTable(r.cmp)
+	maxSeq, err := replayLog(r.fs, filename, mem)
+	if err != nil {
+		return r.archive(filename)
+	}
+	if maxSeq > r.maxSeq {
+		r.maxSeq = maxSeq
+	}
+
+	if mem.ApproximateMemoryUsage() > 0 {
+		tableNum := r.newFileNum()
+		_, err = buildTable(r.fs, r.dirname, tableNum, mem, r.cmp, r.opt.compressor(0), nil)
+		if err != nil {
+			return err
+		}
+		r.tables = append(r.tables, tableNum)
+	}
+	return r.archive(filename)
+}
+
+// scanTable validates the table by reading every entry, recovering its key range and largest sequence number
+func (r *repairer) scanTable(num int) error {
+	filename := dbFilename(r.dirname, fileTypeTable, num)
+	meta, err := r.readTable(filename)
+	if err != nil {
+		return r.archive(filename)
+	}
+	if meta.minKey == nil {
+		// empty tables carry no data worth keeping
+		return r.archive(filename)
+	}
+	meta.fileNum = num
+	if meta.lastSeq > r.maxSeq {
+		r.maxSeq = meta.lastSeq
+	}
+	r.recovered = append(r.recovered, meta)
+	return nil
+}
+
+func (r *repairer) readTable(filename string) (tableFile, error) {
+	f, err := r.fs.Open(filename)
+	if err != nil {
+		return tableFile{}, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return tableFile{}, err
+	}
+	reader, err := table.NewReader(f, int(stat.Size()), r.cmp)
+	if err != nil {
+		return tableFile{}, err
+	}
+
+	meta := tableFile{
+		level: 0,
+		size:  uint64(stat.Size()),
+	}
+	it := reader.Iterator()
+	for {
+		err = it.Next()
+		if err == table.BlockEndErr {
+			break
+		}
+		if err != nil {
+			return tableFile{}, err
+		}
+		key := util.IKey(it.Key())
+		if len(key) < 8 {
+			return tableFile{}, errors.New("corruption: invalid internal key")
+		}
+		if meta.minKey == nil || r.cmp.Compare(key, meta.minKey) < 0 {
+			meta.minKey = append(util.IKey(nil), key...)
+		}
+		if meta.maxKey == nil || r.cmp.Compare(key, meta.maxKey) > 0 {
+			meta.maxKey = append(util.IKey(nil), key...)
+		}
+		if key.SeqNum() > meta.lastSeq {
+			meta.lastSeq = key.SeqNum()
+		}
+	}
+
+	dels, err := reader.RangeDelIterator()
+	if err != nil {
+		return tableFile{}, err
+	}
+	for {
+		err = dels.Next()
+		if err == table.BlockEndErr {
+			break
+		}
+		if err != nil {
+			return tableFile{}, err
+		}
+		key := util.IKey(dels.Key())
+		if len(key) < 8 {
+			return tableFile{}, errors.New("corruption: invalid range tombstone")
+		}
+		t := rangeTombstone{start: key.Key(), end: dels.Value(), seq: key.SeqNum()}
+		meta.minKey, meta.maxKey = extendBounds(r.cmp, meta.minKey, meta.maxKey, t)
+		if t.seq > meta.lastSeq {
+			meta.lastSeq = t.seq
+		}
+	}
+	return meta, nil
+}
+
+func (r *repairer) writeManifest() error {
+	manifestNum := r.newFileNum()
+	ve := NewVersionEdit(r.maxSeq, r.recovered, nil)
+	// every log has been converted, none of them need to be replayed
+	ve.logNum = r.nextFileNum
+	ve.nextFileNum = r.nextFileNum
+	w, err := createNewManifest(r.fs, r.dirname, manifestNum, ve)
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+
+	// the old manifests are no longer referenced by CURRENT
+	for _, num := range r.manifests {
+		err = r.archive(dbFilename(r.dirname, fileTypeManifest, num))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// archive moves a file into the lost directory so that it is kept for inspection but not used
+func (r *repairer) archive(filename string) error {
+	lostDir := filepath.Join(r.dirname, lostDirname)
+	err := r.fs.MkdirAll(lostDir, 0755)
+	if err != nil {
+		return err
+	}
+	err = r.fs.Rename(filename, filepath.Join(lostDir, filepath.Base(filename)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
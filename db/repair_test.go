@@ -0,0 +1,101 @@
+package db
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRepairCorruptedCurrent(t *testing.T) {
+	clearDir()
+
+	var testKVs []testKV
+	for i := 0; i < 200; i++ {
+		testKVs = append(testKVs, testKV{
+			fmt.Sprint("key", i),
+			fmt.Sprint("value", i),
+		})
+	}
+
+	db, err := Open(testdbPath, Opt{maxMemorySize: 500})
+	assert.Nil(t, err)
+	for _, kv := range testKVs {
+		db.Set([]byte(kv.key), []byte(kv.value))
+	}
+	db.Close()
+
+	err = os.WriteFile(dbFilename(testdbPath, fileTypeCurrent, 0), []byte("garbage"), 0644)
+	assert.Nil(t, err)
+	_, err = Open(testdbPath, opt)
+	assert.NotNil(t, err)
+
+	err = Repair(testdbPath, opt)
+	assert.Nil(t, err)
+
+	db2, err := Open(testdbPath, opt)
+	assert.Nil(t, err)
+	defer db2.Close()
+	for _, kv := range testKVs {
+		v, err := db2.Get([]byte(kv.key))
+		assert.Nil(t, err)
+		assert.Equal(t, kv.value, string(v))
+	}
+}
+
+func TestRepairConvertsLog(t *testing.T) {
+	clearDir()
+
+	testKVs := []testKV{
+		{"hello", "world"},
+		{"foo", "bar"},
+	}
+
+	db, err := Open(testdbPath, Opt{maxMemorySize: 10000})
+	assert.Nil(t, err)
+	for _, kv := range testKVs {
+		db.Set([]byte(kv.key), []byte(kv.value))
+	}
+	// simulate a crash, the writes are only in the log
+	db.flock.Close()
+	logName := filepath.Base(dbFilename(testdbPath, fileTypeLog, db.logNum))
+
+	err = Repair(testdbPath, opt)
+	assert.Nil(t, err)
+	_, err = os.Stat(filepath.Join(testdbPath, lostDirname, logName))
+	assert.Nil(t, err)
+
+	db2, err := Open(testdbPath, opt)
+	assert.Nil(t, err)
+	defer db2.Close()
+	for _, kv := range testKVs {
+		v, err := db2.Get([]byte(kv.key))
+		assert.Nil(t, err)
+		assert.Equal(t, kv.value, string(v))
+	}
+}
+
+func TestRepairArchivesCorruptedTable(t *testing.T) {
+	clearDir()
+
+	db, err := Open(testdbPath, opt)
+	assert.Nil(t, err)
+	db.Set([]byte("hello"), []byte("world"))
+	db.Close()
+
+	err = os.WriteFile(dbFilename(testdbPath, fileTypeTable, 99), []byte("not a table"), 0644)
+	assert.Nil(t, err)
+
+	err = Repair(testdbPath, opt)
+	assert.Nil(t, err)
+	_, err = os.Stat(filepath.Join(testdbPath, lostDirname, "000099.ldb"))
+	assert.Nil(t, err)
+
+	db2, err := Open(testdbPath, opt)
+	assert.Nil(t, err)
+	defer db2.Close()
+	v, err := db2.Get([]byte("hello"))
+	assert.Nil(t, err)
+	assert.Equal(t, "world", string(v))
+}
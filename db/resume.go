@@ -0,0 +1,130 @@
+package db
+
+import (
+	"errors"
+	"leveldb_go/record"
+	"syscall"
+)
+
+// BackgroundError is returned by every write once a background flush or compaction, or a
+// write to the log, has failed. It stays until Resume clears it
+type BackgroundError struct {
+	Err error
+	// Retryable is set for errors that may go away, such as a full disk. Other errors,
+	// such as a corrupt table, need the database to be reopened or repaired
+	Retryable bool
+}
+
+func (e *BackgroundError) Error() string {
+	return "background error: " + e.Err.Error()
+}
+
+func (e *BackgroundError) Unwrap() error {
+	return e.Err
+}
+
+func newBackgroundError(err error) *BackgroundError {
+	return &BackgroundError{
+		Err:       err,
+		Retryable: errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT),
+	}
+}
+
+// Resume clears a retryable background error, for example once the operator has freed
+// space, and retries the flush or compaction that failed. Writes are accepted again if
+// Resume returns nil. A fatal error is returned as is and stays
+func (db *DB) Resume() error {
+	return db.exclusive(func() error {
+		return db.resume()
+	})
+}
+
+func (db *DB) resume() error {
+	if db.readOnly {
+		return ReadOnlyErr
+	}
+	var bgErr *BackgroundError
+	if !errors.As(db.bgErr, &bgErr) {
+		return nil
+	}
+	if !bgErr.Retryable {
+		return bgErr
+	}
+	// a failed log write doesn't stop a compaction that is already running
+	for db.bgScheduled {
+		db.bgCond.Wait()
+	}
+
+	if !db.inMemory {
+		// a failed write may have left a partial record at the end of the manifest or the
+		// log, which would hide the records written after it
+		err := db.rotateManifest()
+		if err != nil {
+			return err
+		}
+		if db.mem.ApproximateMemoryUsage() == 0 {
+			err = db.rotateLog()
+			if err != nil {
+				return err
+			}
+		}
+		db.removeOrphanTables()
+	}
+
+	db.bgErr = nil
+	db.maybeScheduleCompaction()
+	// the memtable is switched to a new log if it holds anything
+	err := db.flushMemTable()
+	if err != nil {
+		return err
+	}
+	return db.waitForCompactions()
+}
+
+// rotateManifest continues the manifest in a new file starting with the current version.
+// db.mu must be held
+func (db *DB) rotateManifest() error {
+	fileNum := db.versionSet.newFileNum()
+	w, err := createNewManifest(db.fs, db.dirname, fileNum, db.versionSet.AsVersionEdit())
+	if err != nil {
+		return err
+	}
+	db.manifest.Close()
+	db.fs.Remove(dbFilename(db.dirname, fileTypeManifest, db.manifest.fileNum))
+	db.manifest = &manifest{fileNum: fileNum, writer: w}
+	return nil
+}
+
+// rotateLog switches to a new log and removes the current one. It must only be called
+// while the memtable is empty, so that no entry of the current log is needed.
+// db.mu must be held
+func (db *DB) rotateLog() error {
+	logNum := db.versionSet.newFileNum()
+	logFile, err := db.fs.Create(dbFilename(db.dirname, fileTypeLog, logNum))
+	if err != nil {
+		return err
+	}
+	db.logWriter.Close()
+	db.fs.Remove(dbFilename(db.dirname, fileTypeLog, db.logNum))
+	db.logWriter = record.NewWriter(logFile)
+	db.logNum = logNum
+	return nil
+}
+
+// removeOrphanTables removes the tables that no version holds, such as the output of a
+// flush or compaction whose manifest edit failed. db.mu must be held and no background
+// work may be running
+func (db *DB) removeOrphanTables() {
+	db.removeObsoleteTables()
+	names, err := db.fs.List(db.dirname)
+	if err != nil {
+		return
+	}
+	live := db.liveTables()
+	for _, name := range names {
+		ft, num, ok := parseDBFilename(name)
+		if ok && ft == fileTypeTable && !live[num] {
+			db.fs.Remove(dbFilename(db.dirname, fileTypeTable, num))
+		}
+	}
+}
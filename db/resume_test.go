@@ -0,0 +1,83 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"leveldb_go/vfs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestResumeAfterDiskFull(t *testing.T) {
+	fs := vfs.NewFault(vfs.NewMem())
+	fs.SetFaultErr(syscall.ENOSPC)
+	resumeOpt := Opt{maxMemorySize: 300, FS: fs}
+	db, err := Open(testdbPath, resumeOpt)
+	assert.Nil(t, err)
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, db.Set([]byte(fmt.Sprint("key", i)), []byte(fmt.Sprint("value", i))))
+	}
+
+	fs.InjectFault(vfs.OpWrite, 0, true)
+	err = db.Set([]byte("lost"), []byte("value"))
+	var bgErr *BackgroundError
+	assert.True(t, errors.As(err, &bgErr))
+	assert.True(t, bgErr.Retryable)
+	assert.True(t, errors.Is(err, syscall.ENOSPC))
+	// the error is sticky and Resume fails until there is space again
+	assert.NotNil(t, db.Set([]byte("key0"), []byte("value")))
+	assert.NotNil(t, db.Resume())
+	assert.NotNil(t, db.Set([]byte("key0"), []byte("value")))
+
+	fs.ClearFaults()
+	assert.Nil(t, db.Resume())
+	for i := 20; i < 100; i++ {
+		assert.Nil(t, db.Set([]byte(fmt.Sprint("key", i)), []byte(fmt.Sprint("value", i))))
+	}
+	assert.Nil(t, db.Close())
+
+	db, err = Open(testdbPath, resumeOpt)
+	assert.Nil(t, err)
+	defer db.Close()
+	for i := 0; i < 100; i++ {
+		v, err := db.Get([]byte(fmt.Sprint("key", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprint("value", i), string(v))
+	}
+	_, err = db.Get([]byte("lost"))
+	assert.NotNil(t, err)
+}
+
+func TestFatalBackgroundError(t *testing.T) {
+	writeLevel0(t, 2)
+	names, err := os.ReadDir(testdbPath)
+	assert.Nil(t, err)
+	for _, name := range names {
+		ft, _, ok := parseDBFilename(name.Name())
+		if ok && ft == fileTypeTable {
+			path := filepath.Join(testdbPath, name.Name())
+			data, err := os.ReadFile(path)
+			assert.Nil(t, err)
+			data[0] ^= 0xff
+			assert.Nil(t, os.WriteFile(path, data, 0644))
+			break
+		}
+	}
+
+	// compacting the corrupt table fails
+	fatalOpt := opt
+	fatalOpt.L0CompactionTrigger = 2
+	db, err := Open(testdbPath, fatalOpt)
+	assert.Nil(t, err)
+	waitForCompactions(db)
+
+	err = db.Set([]byte("key"), []byte("value"))
+	var bgErr *BackgroundError
+	assert.True(t, errors.As(err, &bgErr))
+	assert.False(t, bgErr.Retryable)
+	assert.Equal(t, err, db.Resume())
+	assert.Equal(t, err, db.Close())
+}
@@ -0,0 +1,198 @@
+package db
+
+import (
+	"errors"
+	"io"
+	"leveldb_go/record"
+	"leveldb_go/util"
+	"os"
+	"sort"
+	"sync"
+)
+
+// secondary tracks what a secondary instance has read from the primary, so that catching up
+// only reads what was appended since
+type secondary struct {
+	manifestNum int
+	// manifestOffset is the end of the last edit applied from the manifest
+	manifestOffset int64
+	// logOffsets holds the end of the last batch replayed from each live log
+	logOffsets map[int]int64
+}
+
+// OpenSecondary opens a read-only view of the database in primaryDir that can follow the writes
+// of the primary through TryCatchUpWithPrimary. The primary's files are only read. secondaryDir
+// holds the lock of the secondary instance, so several secondaries need separate directories.
+func OpenSecondary(primaryDir, secondaryDir string, opt Opt) (*DB, error) {
+	fs := opt.fs()
+	err := fs.MkdirAll(secondaryDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	flock, err := lockDB(fs, secondaryDir)
+	if err != nil {
+		return nil, err
+	}
+
+	db := &DB{
+		fs:         fs,
+		dirname:    primaryDir,
+		mem:        opt.newMemTable(util.IKeyStringCmp),
+		flock:      flock,
+		cmp:        util.IKeyStringCmp,
+		ucmp:       &util.StringComparator{},
+		opt:        opt,
+		versionSet: NewVersionSet(),
+		readOnly:   true,
+		secondary:  &secondary{logOffsets: make(map[int]int64)},
+	}
+	db.bgCond = sync.NewCond(&db.mu)
+	err = db.TryCatchUpWithPrimary()
+	if err != nil {
+		flock.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// TryCatchUpWithPrimary makes the writes the primary has made since the last call visible.
+// The edits appended to the manifest are applied and the batches appended to the live logs
+// are added to the memtable. Reads may run concurrently, they see the state before or after
+// the call. Tables the primary removes after a call, once a compaction no longer needs
+// them, fail the reads that search them until the next call
+func (db *DB) TryCatchUpWithPrimary() error {
+	return db.exclusive(func() error {
+		return db.tryCatchUpWithPrimary()
+	})
+}
+
+func (db *DB) tryCatchUpWithPrimary() error {
+	if db.secondary == nil {
+		return errors.New("not a secondary instance")
+	}
+	var err error
+	// the primary may switch manifests or delete a log while we read, in which case
+	// trying again sees the newer state. What was read so far is kept
+	for attempt := 0; attempt < 3; attempt++ {
+		err = db.catchUp()
+		if !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return err
+}
+
+func (db *DB) catchUp() error {
+	s := db.secondary
+	// the logs are listed before the manifest is read, so that a log the primary flushes
+	// and removes in between is either listed or has its table in the version read. One
+	// removed after the listing fails the replay, and catching up is tried again
+	logs, err := db.listLogs()
+	if err != nil {
+		return err
+	}
+	err = db.catchUpManifest()
+	if err != nil {
+		return err
+	}
+	for len(logs) > 0 && logs[0] < db.versionSet.logNum {
+		logs = logs[1:]
+	}
+	if db.seqNum < db.versionSet.currentVersion.seqNum() {
+		db.seqNum = db.versionSet.currentVersion.seqNum()
+	}
+
+	// entries can't be removed from a memtable, so once the primary has flushed a log the
+	// memtable is rebuilt from the logs still live. Otherwise only new batches are added
+	mem, offsets := db.mem, s.logOffsets
+	live := make(map[int]bool)
+	for _, num := range logs {
+		live[num] = true
+	}
+	for num := range s.logOffsets {
+		if !live[num] {
+			mem, offsets = db.opt.newMemTable(db.cmp), make(map[int]int64)
+			break
+		}
+	}
+	seqNum := db.seqNum
+	for _, num := range logs {
+		maxSeq, end, err := replayLogFrom(db.fs, dbFilename(db.dirname, fileTypeLog, num), mem, offsets[num])
+		if err != nil {
+			return err
+		}
+		offsets[num] = end
+		if maxSeq > seqNum {
+			seqNum = maxSeq
+		}
+		if mem == db.mem {
+			// the batches are visible as soon as they are in the memtable
+			db.seqNum = seqNum
+		}
+	}
+	db.mem, s.logOffsets, db.seqNum = mem, offsets, seqNum
+	return nil
+}
+
+// catchUpManifest applies the edits appended to the manifest since the last call, or reads
+// the whole version set if the primary has switched to a new manifest
+func (db *DB) catchUpManifest() error {
+	s := db.secondary
+	manifestNum, err := readCurrentFile(db.fs, db.dirname)
+	if err != nil {
+		return err
+	}
+	f, err := db.fs.Open(dbFilename(db.dirname, fileTypeManifest, manifestNum))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if manifestNum != s.manifestNum {
+		reader := record.NewReader(f)
+		vs, err := ReadManifest(reader)
+		if err != nil {
+			return err
+		}
+		db.versionSet = vs
+		s.manifestNum, s.manifestOffset = manifestNum, reader.Offset()
+		return nil
+	}
+	reader, err := record.NewReaderAt(f, s.manifestOffset)
+	if err != nil {
+		return err
+	}
+	for {
+		data, err := reader.ReadBlock()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var ve VersionEdit
+		err = ve.decode(data)
+		if err != nil {
+			return err
+		}
+		db.versionSet.ApplyVersionEdit(&ve)
+		s.manifestOffset = reader.Offset()
+	}
+}
+
+// listLogs returns the numbers of the logs in the database directory, oldest first
+func (db *DB) listLogs() ([]int, error) {
+	names, err := db.fs.List(db.dirname)
+	if err != nil {
+		return nil, err
+	}
+	var logs []int
+	for _, name := range names {
+		ft, num, ok := parseDBFilename(name)
+		if ok && ft == fileTypeLog {
+			logs = append(logs, num)
+		}
+	}
+	sort.Ints(logs)
+	return logs, nil
+}
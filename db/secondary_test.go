@@ -0,0 +1,155 @@
+package db
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"leveldb_go/vfs"
+	"testing"
+)
+
+const secondaryPath = "testdb/secondary"
+
+func TestSecondaryCatchUp(t *testing.T) {
+	clearDir()
+
+	primary, err := Open(testdbPath, Opt{maxMemorySize: 300})
+	assert.Nil(t, err)
+	primary.Set([]byte("key0"), []byte("value0"))
+
+	sec, err := OpenSecondary(testdbPath, secondaryPath, opt)
+	assert.Nil(t, err)
+	defer sec.Close()
+	v, err := sec.Get([]byte("key0"))
+	assert.Nil(t, err)
+	assert.Equal(t, "value0", string(v))
+
+	// enough writes to flush tables and switch logs
+	for i := 1; i < 100; i++ {
+		primary.Set([]byte(fmt.Sprint("key", i)), []byte(fmt.Sprint("value", i)))
+	}
+	_, err = sec.Get([]byte("key99"))
+	assert.NotNil(t, err)
+
+	// a compaction finishing after the catch up would remove tables the secondary reads
+	waitForCompactions(primary)
+	assert.Nil(t, sec.TryCatchUpWithPrimary())
+	for i := 0; i < 100; i++ {
+		v, err := sec.Get([]byte(fmt.Sprint("key", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprint("value", i), string(v))
+	}
+	assert.Equal(t, ReadOnlyErr, sec.Set([]byte("key"), []byte("value")))
+
+	// the primary writes a new manifest when it is reopened
+	primary.Close()
+	primary, err = Open(testdbPath, Opt{maxMemorySize: 300})
+	assert.Nil(t, err)
+	defer primary.Close()
+	primary.Set([]byte("key0"), []byte("updated"))
+
+	assert.Nil(t, sec.TryCatchUpWithPrimary())
+	v, err = sec.Get([]byte("key0"))
+	assert.Nil(t, err)
+	assert.Equal(t, "updated", string(v))
+	v, err = sec.Get([]byte("key50"))
+	assert.Nil(t, err)
+	assert.Equal(t, "value50", string(v))
+}
+
+func TestSecondaryTailsLog(t *testing.T) {
+	clearDir()
+
+	primary, err := Open(testdbPath, Opt{})
+	assert.Nil(t, err)
+	defer primary.Close()
+	sec, err := OpenSecondary(testdbPath, secondaryPath, opt)
+	assert.Nil(t, err)
+	defer sec.Close()
+
+	// the log is read from where the last catch up stopped, into the same memtable
+	mem := sec.mem
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, primary.Set([]byte(fmt.Sprint("key", i)), []byte(fmt.Sprint("value", i))))
+		assert.Nil(t, sec.TryCatchUpWithPrimary())
+		v, err := sec.Get([]byte(fmt.Sprint("key", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprint("value", i), string(v))
+	}
+	assert.True(t, mem == sec.mem)
+	assert.Equal(t, 1, len(sec.secondary.logOffsets))
+
+	// once the log is flushed the memtable only holds the newer log
+	primary.mu.Lock()
+	assert.Nil(t, primary.flushMemTable())
+	primary.mu.Unlock()
+	waitForCompactions(primary)
+	assert.Nil(t, primary.Set([]byte("key0"), []byte("updated")))
+	assert.Nil(t, sec.TryCatchUpWithPrimary())
+	assert.True(t, mem != sec.mem)
+	assert.Equal(t, 1, len(sec.secondary.logOffsets))
+	v, err := sec.Get([]byte("key0"))
+	assert.Nil(t, err)
+	assert.Equal(t, "updated", string(v))
+	v, err = sec.Get([]byte("key9"))
+	assert.Nil(t, err)
+	assert.Equal(t, "value9", string(v))
+}
+
+// listHookFS calls onList once, before its next listing of a directory
+type listHookFS struct {
+	vfs.FS
+	onList func()
+}
+
+func (fs *listHookFS) List(dirname string) ([]string, error) {
+	if fs.onList != nil {
+		onList := fs.onList
+		fs.onList = nil
+		onList()
+	}
+	return fs.FS.List(dirname)
+}
+
+func TestSecondaryCatchUpDuringFlush(t *testing.T) {
+	clearDir()
+
+	primary, err := Open(testdbPath, Opt{})
+	assert.Nil(t, err)
+	defer primary.Close()
+	fs := &listHookFS{FS: vfs.Default}
+	sec, err := OpenSecondary(testdbPath, secondaryPath, Opt{FS: fs})
+	assert.Nil(t, err)
+	defer sec.Close()
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, primary.Set([]byte(fmt.Sprint("key", i)), []byte(fmt.Sprint("value", i))))
+	}
+
+	// the primary flushes its memtable and removes the log while the secondary catches up
+	fs.onList = func() {
+		primary.mu.Lock()
+		assert.Nil(t, primary.flushMemTable())
+		primary.mu.Unlock()
+		waitForCompactions(primary)
+	}
+	assert.Nil(t, sec.TryCatchUpWithPrimary())
+	assert.Nil(t, fs.onList)
+	for i := 0; i < 10; i++ {
+		v, err := sec.Get([]byte(fmt.Sprint("key", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, fmt.Sprint("value", i), string(v))
+	}
+}
+
+func TestSecondaryLock(t *testing.T) {
+	clearDir()
+
+	primary, err := Open(testdbPath, opt)
+	assert.Nil(t, err)
+	defer primary.Close()
+
+	sec, err := OpenSecondary(testdbPath, secondaryPath, opt)
+	assert.Nil(t, err)
+	defer sec.Close()
+	_, err = OpenSecondary(testdbPath, secondaryPath, opt)
+	assert.Equal(t, LockErr, err)
+}
@@ -0,0 +1,32 @@
+package db
+
+import "time"
+
+// Stats counts the background work of a database and the time writes waited for it
+type Stats struct {
+	Flushes     int64
+	Compactions int64
+
+	// writes delayed by 1ms because level 0 had L0SlowdownWritesTrigger tables
+	SlowdownWrites   int64
+	SlowdownDuration time.Duration
+	// writes that waited for level 0 to drop below L0StopWritesTrigger tables
+	StopWrites   int64
+	StopDuration time.Duration
+	// writes that waited for the previous memtable to be flushed
+	MemTableStops        int64
+	MemTableStopDuration time.Duration
+
+	// LevelFiles is the number of tables in each level
+	LevelFiles [numLevels]int
+}
+
+func (db *DB) Stats() Stats {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	stats := db.stats
+	for level, files := range db.versionSet.currentVersion.files {
+		stats.LevelFiles[level] = len(files)
+	}
+	return stats
+}
@@ -0,0 +1,45 @@
+package db
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// the value of an entry with a TTL starts with its expiry, in nanoseconds since the epoch
+const expiryLen = 8
+
+func (o Opt) now() time.Time {
+	if o.Now == nil {
+		return time.Now()
+	}
+	return o.Now()
+}
+
+// SetWithTTL sets key to value until ttl has passed on Opt.Now. Expired values are
+// absent for reads and dropped by compactions
+func (db *DB) SetWithTTL(key, value []byte, ttl time.Duration) error {
+	b := NewWriteBatch()
+	b.setWithExpiry(key, value, db.opt.now().Add(ttl))
+	return db.Write(b)
+}
+
+func expiringValue(value []byte, expiry time.Time) []byte {
+	v := binary.LittleEndian.AppendUint64(make([]byte, 0, expiryLen+len(value)), uint64(expiry.UnixNano()))
+	return append(v, value...)
+}
+
+// splitExpiry returns the expiry and the value of an entry with a TTL. A value too short
+// to hold an expiry is treated as expired
+func splitExpiry(value []byte) (int64, []byte) {
+	if len(value) < expiryLen {
+		return 0, nil
+	}
+	return int64(binary.LittleEndian.Uint64(value)), value[expiryLen:]
+}
+
+// expired reports whether the value of an entry with a TTL has expired at now, in
+// nanoseconds since the epoch
+func expired(value []byte, now int64) bool {
+	expiry, _ := splitExpiry(value)
+	return expiry <= now
+}
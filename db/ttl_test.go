@@ -0,0 +1,103 @@
+package db
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testClock is a clock that only moves when the test advances it
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestSetWithTTL(t *testing.T) {
+	clearDir()
+	clock := &testClock{now: time.Unix(1000, 0)}
+	ttlOpt := withoutCompaction(Opt{Now: clock.Now})
+	db, err := Open(testdbPath, ttlOpt)
+	assert.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, db.SetWithTTL([]byte(fmt.Sprint("short", i)), []byte("value"), time.Minute))
+		assert.Nil(t, db.SetWithTTL([]byte(fmt.Sprint("long", i)), []byte("value"), time.Hour))
+		assert.Nil(t, db.Set([]byte(fmt.Sprint("key", i)), []byte("value")))
+	}
+	check := func(shortLive bool) {
+		for i := 0; i < 10; i++ {
+			v, err := db.Get([]byte(fmt.Sprint("short", i)))
+			if shortLive {
+				assert.Nil(t, err)
+				assert.Equal(t, "value", string(v))
+			} else {
+				assert.NotNil(t, err)
+			}
+			v, err = db.Get([]byte(fmt.Sprint("long", i)))
+			assert.Nil(t, err)
+			assert.Equal(t, "value", string(v))
+			v, err = db.Get([]byte(fmt.Sprint("key", i)))
+			assert.Nil(t, err)
+			assert.Equal(t, "value", string(v))
+		}
+	}
+	check(true)
+	clock.advance(2 * time.Minute)
+	check(false)
+	assert.Nil(t, db.Close())
+
+	db, err = Open(testdbPath, ttlOpt)
+	assert.Nil(t, err)
+	defer db.Close()
+	check(false)
+
+	// the compaction drops the expired values
+	db.mu.Lock()
+	assert.Nil(t, db.compactLevel0())
+	db.mu.Unlock()
+	assert.Equal(t, 20, len(tableEntries(t, db, 1)))
+	check(false)
+	clock.advance(time.Hour)
+	for i := 0; i < 10; i++ {
+		_, err := db.Get([]byte(fmt.Sprint("long", i)))
+		assert.NotNil(t, err)
+	}
+}
+
+func TestExpiredValueHidesOlderValue(t *testing.T) {
+	clearDir()
+	clock := &testClock{now: time.Unix(1000, 0)}
+	db, err := Open(testdbPath, withoutCompaction(Opt{Now: clock.Now}))
+	assert.Nil(t, err)
+	defer db.Close()
+
+	ext := filepath.Join("testdb", "ext.sst")
+	writeSST(t, ext, []testKV{{"key", "old"}})
+	assert.Nil(t, db.IngestExternalFiles([]string{ext}))
+	assert.Nil(t, db.SetWithTTL([]byte("key"), []byte("new"), time.Minute))
+	v, err := db.Get([]byte("key"))
+	assert.Nil(t, err)
+	assert.Equal(t, "new", string(v))
+
+	clock.advance(time.Minute)
+	db.mu.Lock()
+	assert.Nil(t, db.flushMemTable())
+	assert.Nil(t, db.compactLevel0())
+	db.mu.Unlock()
+	_, err = db.Get([]byte("key"))
+	assert.NotNil(t, err)
+}
@@ -51,7 +51,7 @@ func (b byFileNum) Len() int {
 type byMinKey []tableFile
 
 func (b byMinKey) Less(i, j int) bool {
-	return b[i].fileNum < b[j].fileNum
+	return util.IKeyStringCmp.Compare(b[i].minKey, b[j].minKey) < 0
 }
 
 func (b byMinKey) Swap(i, j int) {
@@ -64,9 +64,12 @@ func (b byMinKey) Len() int {
 
 func (v *Version) applyVersionEdit(ve *VersionEdit) *Version {
 	version := Version{
-		seq:  ve.newSeq,
+		seq:  v.seq,
 		refs: 0,
 	}
+	if ve.newSeq != 0 {
+		version.seq = ve.newSeq
+	}
 
 	var filesToAdd [numLevels][]tableFile
 	var filesToRemove [numLevels][]tableFile
@@ -109,6 +112,8 @@ func (v *Version) applyVersionEdit(ve *VersionEdit) *Version {
 
 type VersionEdit struct {
 	newSeq        uint64
+	logNum        int // logs older than logNum are no longer needed, 0 if unchanged
+	nextFileNum   int // 0 if unchanged
 	filesToAdd    []tableFile
 	filesToRemove []tableFile
 }
@@ -137,11 +142,29 @@ type Snapshot struct {
 
 type VersionSet struct {
 	currentVersion *Version
+
+	// file numbers for tables, logs and manifests are all allocated from nextFileNum
+	nextFileNum int
+	logNum      int
 }
 
 func NewVersionSet() *VersionSet {
 	return &VersionSet{
 		currentVersion: newVersion(0),
+		nextFileNum:    1,
+	}
+}
+
+func (v *VersionSet) newFileNum() int {
+	num := v.nextFileNum
+	v.nextFileNum++
+	return num
+}
+
+// markFileNumUsed makes sure num is never handed out by newFileNum
+func (v *VersionSet) markFileNumUsed(num int) {
+	if v.nextFileNum <= num {
+		v.nextFileNum = num + 1
 	}
 }
 
@@ -157,6 +180,18 @@ func (ve *VersionEdit) decode(data []byte) error {
 		}
 
 		switch tag {
+		case tagLogNumber:
+			logNum, err := binary.ReadUvarint(r)
+			if err != nil {
+				return err
+			}
+			ve.logNum = int(logNum)
+		case tagNextFileNumber:
+			nextFileNum, err := binary.ReadUvarint(r)
+			if err != nil {
+				return err
+			}
+			ve.nextFileNum = int(nextFileNum)
 		case tagLastSequence:
 			lastSeq, err := binary.ReadUvarint(r)
 			if err != nil {
@@ -221,7 +256,7 @@ func (ve *VersionEdit) decode(data []byte) error {
 }
 
 func ReadManifest(reader *record.Reader) (*VersionSet, error) {
-	version := newVersion(0)
+	vs := NewVersionSet()
 	for {
 		block, err := reader.ReadBlock()
 		if err == io.EOF {
@@ -236,18 +271,25 @@ func ReadManifest(reader *record.Reader) (*VersionSet, error) {
 		if err != nil {
 			return nil, err
 		}
-		version = version.applyVersionEdit(&ve) // TODO should optimize
+		vs.currentVersion = vs.currentVersion.applyVersionEdit(&ve) // TODO should optimize
+		vs.applyCounters(&ve)
 	}
 
-	return &VersionSet{
-		currentVersion: version,
-	}, nil
+	// older manifests did not record the next file number
+	for _, files := range vs.currentVersion.files {
+		for _, f := range files {
+			vs.markFileNumUsed(f.fileNum)
+		}
+	}
+	return vs, nil
 }
 
 const (
-	tagLastSequence = 4
-	tagDeletedFile  = 6
-	tagNewFile      = 7
+	tagLogNumber      = 2
+	tagNextFileNumber = 3
+	tagLastSequence   = 4
+	tagDeletedFile    = 6
+	tagNewFile        = 7
 )
 
 type ManifestWriter struct {
@@ -258,46 +300,47 @@ type ManifestWriter struct {
 func NewManifestWriter(w *record.Writer) *ManifestWriter {
 	return &ManifestWriter{
 		w:   w,
-		buf: make([]byte, 1000), // terrible idea
+		buf: make([]byte, 0, 1000),
 	}
 }
 
 func (m *ManifestWriter) Append(ve *VersionEdit) error {
-	m.buf = m.buf[:]
-	n := 0
+	m.buf = m.buf[:0]
+	if ve.logNum != 0 {
+		m.buf = binary.AppendUvarint(m.buf, tagLogNumber)
+		m.buf = binary.AppendUvarint(m.buf, uint64(ve.logNum))
+	}
+	if ve.nextFileNum != 0 {
+		m.buf = binary.AppendUvarint(m.buf, tagNextFileNumber)
+		m.buf = binary.AppendUvarint(m.buf, uint64(ve.nextFileNum))
+	}
 	if ve.newSeq != 0 {
-		n += binary.PutUvarint(m.buf[n:], tagLastSequence)
-		n += binary.PutUvarint(m.buf[n:], ve.newSeq)
+		m.buf = binary.AppendUvarint(m.buf, tagLastSequence)
+		m.buf = binary.AppendUvarint(m.buf, ve.newSeq)
 	}
 	for _, f := range ve.filesToRemove {
-		n += binary.PutUvarint(m.buf[n:], tagDeletedFile)
-		n += binary.PutUvarint(m.buf[n:], uint64(f.level))
-		n += binary.PutUvarint(m.buf[n:], uint64(f.fileNum))
+		m.buf = binary.AppendUvarint(m.buf, tagDeletedFile)
+		m.buf = binary.AppendUvarint(m.buf, uint64(f.level))
+		m.buf = binary.AppendUvarint(m.buf, uint64(f.fileNum))
 	}
 	for _, f := range ve.filesToAdd {
-		n += binary.PutUvarint(m.buf[n:], tagNewFile)
-		n += binary.PutUvarint(m.buf[n:], uint64(f.level))
-		n += binary.PutUvarint(m.buf[n:], uint64(f.fileNum))
-		n += binary.PutUvarint(m.buf[n:], f.size)
-
-		n += binary.PutUvarint(m.buf[n:], uint64(len(f.minKey)))
-		n += copy(m.buf[n:], f.minKey)
-		n += binary.PutUvarint(m.buf[n:], uint64(len(f.maxKey)))
-		n += copy(m.buf[n:], f.maxKey)
-	}
-	_, err := m.w.Write(m.buf[:n])
-	if err != nil {
-		return err
+		m.buf = binary.AppendUvarint(m.buf, tagNewFile)
+		m.buf = binary.AppendUvarint(m.buf, uint64(f.level))
+		m.buf = binary.AppendUvarint(m.buf, uint64(f.fileNum))
+		m.buf = binary.AppendUvarint(m.buf, f.size)
+
+		m.buf = binary.AppendUvarint(m.buf, uint64(len(f.minKey)))
+		m.buf = append(m.buf, f.minKey...)
+		m.buf = binary.AppendUvarint(m.buf, uint64(len(f.maxKey)))
+		m.buf = append(m.buf, f.maxKey...)
 	}
-
-	err = m.w.Flush()
+	_, err := m.w.Write(m.buf)
 	if err != nil {
 		return err
 	}
 
-	// TODO need to SYNC here
-
-	return nil
+	// the edit has to be durable before it is applied
+	return m.w.Sync()
 }
 
 func (m *ManifestWriter) Close() error {
@@ -308,15 +351,28 @@ func (m *ManifestWriter) Close() error {
 func (v *VersionSet) ApplyVersionEdit(ve *VersionEdit) {
 	version := v.currentVersion.applyVersionEdit(ve)
 	v.Append(version)
+	v.applyCounters(ve)
+}
+
+func (v *VersionSet) applyCounters(ve *VersionEdit) {
+	if ve.logNum != 0 {
+		v.logNum = ve.logNum
+	}
+	if ve.nextFileNum != 0 {
+		v.markFileNumUsed(ve.nextFileNum - 1)
+	}
 }
 
+// AsVersionEdit returns a single edit that recreates the current state of the version set
 func (v *VersionSet) AsVersionEdit() *VersionEdit {
 	var files []tableFile
 	for _, filesForLevel := range v.currentVersion.files {
 		files = append(files, filesForLevel...)
 	}
 	return &VersionEdit{
-		newSeq:        0,
+		newSeq:        v.currentVersion.seq,
+		logNum:        v.logNum,
+		nextFileNum:   v.nextFileNum,
 		filesToAdd:    files,
 		filesToRemove: nil,
 	}
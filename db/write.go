@@ -0,0 +1,250 @@
+package db
+
+import (
+	"leveldb_go/util"
+	"sync"
+	"time"
+)
+
+// WriteBatch holds updates that DB.Write applies atomically
+type WriteBatch struct {
+	batch
+}
+
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{*newBatch()}
+}
+
+func (b *WriteBatch) Set(key, value []byte) {
+	b.set(key, value)
+}
+
+// Merge adds operand to the value of key, see DB.Merge
+func (b *WriteBatch) Merge(key, operand []byte) {
+	b.merge(key, operand)
+}
+
+// DeleteRange deletes the keys in [start, end)
+func (b *WriteBatch) DeleteRange(start, end []byte) {
+	b.deleteRange(start, end)
+}
+
+// Len returns the number of updates in the batch
+func (b *WriteBatch) Len() int {
+	return int(b.count())
+}
+
+func (b *WriteBatch) Reset() {
+	b.data = b.data[:batchHeaderLen]
+	for i := range b.data {
+		b.data[i] = 0
+	}
+}
+
+const defaultMaxGroupSize = 1 << 20
+
+func (o Opt) maxGroupSize() int {
+	if o.MaxGroupSize == 0 {
+		return defaultMaxGroupSize
+	}
+	return o.MaxGroupSize
+}
+
+// writer is a queued call to Write, or to exclusive if batch is nil.
+// The writer at the head of db.writers is the leader, it commits the batches of the
+// writers behind it along with its own and sets their results
+type writer struct {
+	batch *batch
+	done  bool
+	err   error
+	cond  *sync.Cond
+}
+
+// Write applies the updates in b. Concurrent calls are committed in groups, with one
+// log record and one sync per group
+func (db *DB) Write(b *WriteBatch) error {
+	if db.readOnly {
+		return ReadOnlyErr
+	}
+	if b.Len() == 0 {
+		return nil
+	}
+
+	w := &writer{batch: &b.batch, cond: sync.NewCond(&db.mu)}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	db.writers = append(db.writers, w)
+	for !w.done && db.writers[0] != w {
+		w.cond.Wait()
+	}
+	if w.done {
+		return w.err
+	}
+
+	last := w
+	err := db.makeRoomForWrite(len(w.batch.data) - batchHeaderLen)
+	if err == nil {
+		var group *batch
+		group, last = db.buildBatchGroup()
+		seq := db.seqNum + 1
+		group.setSeq(seq)
+
+		// the other writers wait behind this one, so the log and the memtable can be
+		// written without holding the lock
+		mem := db.mem
+		db.mu.Unlock()
+		err = db.writeToLog(group)
+		if err == nil {
+			err = group.forEach(func(ikey util.IKey, value []byte) {
+				mem.Add(ikey, value)
+			})
+		}
+		db.mu.Lock()
+		if err == nil {
+			// the group only becomes visible to readers now
+			db.seqNum = seq + uint64(group.count()) - 1
+		} else {
+			// the log may end in a partial record now, later writes wait for Resume to
+			// switch to a new one
+			db.bgErr = newBackgroundError(err)
+			err = db.bgErr
+		}
+	}
+	db.finishWriters(last, err)
+	return err
+}
+
+// makeRoomForWrite switches to a new memtable if n more bytes don't fit. Writes are
+// delayed while level 0 is at L0SlowdownWritesTrigger tables, and wait for compaction at
+// L0StopWritesTrigger tables or while the previous memtable is being flushed.
+// db.mu must be held, it is released while waiting
+func (db *DB) makeRoomForWrite(n int) error {
+	if db.inMemory {
+		err := db.checkMemoryLimit(n)
+		if err != nil {
+			return err
+		}
+	}
+	allowDelay := true
+	var memTableStopped, stopped bool
+	for {
+		if db.bgErr != nil {
+			return db.bgErr
+		}
+		l0 := len(db.versionSet.currentVersion.files[0])
+		size := db.mem.ApproximateMemoryUsage()
+		switch {
+		case allowDelay && l0 >= db.opt.l0SlowdownWritesTrigger():
+			// delaying every write a little spreads the wait, rather than stopping a
+			// single write for as long as a compaction takes once the hard limit is hit
+			start := time.Now()
+			db.mu.Unlock()
+			time.Sleep(time.Millisecond)
+			db.mu.Lock()
+			db.stats.SlowdownWrites++
+			db.stats.SlowdownDuration += time.Since(start)
+			allowDelay = false
+		case size == 0 || size+n <= db.opt.memTableSize():
+			return nil
+		case db.imm != nil:
+			if !memTableStopped {
+				db.stats.MemTableStops++
+				memTableStopped = true
+			}
+			start := time.Now()
+			db.bgCond.Wait()
+			db.stats.MemTableStopDuration += time.Since(start)
+		case l0 >= db.opt.l0StopWritesTrigger():
+			if db.abortCompactions.Load() {
+				// no compaction is going to make room
+				return ErrClosed
+			}
+			if !stopped {
+				db.stats.StopWrites++
+				stopped = true
+			}
+			start := time.Now()
+			db.maybeScheduleCompaction()
+			db.bgCond.Wait()
+			db.stats.StopDuration += time.Since(start)
+		default:
+			return db.switchMemTable()
+		}
+	}
+}
+
+// buildBatchGroup merges the batch of the leader with the batches queued behind it and
+// returns the merged batch and the last writer it includes
+func (db *DB) buildBatchGroup() (*batch, *writer) {
+	first := db.writers[0]
+	size := len(first.batch.data)
+	maxSize := db.opt.maxGroupSize()
+	// don't make a small write wait for a large group
+	if size <= 128<<10 && size+128<<10 < maxSize {
+		maxSize = size + 128<<10
+	}
+
+	last := first
+	var group *batch
+	// in-memory databases have no log to share, and check their limit per batch
+	for _, w := range db.writers[1:] {
+		if db.inMemory || w.batch == nil || size+len(w.batch.data)-batchHeaderLen > maxSize {
+			break
+		}
+		if group == nil {
+			group = newBatch()
+			group.append(first.batch)
+		}
+		group.append(w.batch)
+		size += len(w.batch.data) - batchHeaderLen
+		last = w
+	}
+	if group == nil {
+		return first.batch, first
+	}
+	return group, last
+}
+
+// finishWriters removes the writers up to last from the queue, hands them err and wakes
+// up the next leader. db.mu must be held
+func (db *DB) finishWriters(last *writer, err error) {
+	for {
+		w := db.writers[0]
+		db.writers = db.writers[1:]
+		w.err = err
+		w.done = true
+		w.cond.Signal()
+		if w == last {
+			break
+		}
+	}
+	if len(db.writers) > 0 {
+		db.writers[0].cond.Signal()
+	}
+}
+
+// exclusive runs fn holding db.mu once every queued write is done, and keeps later
+// writes waiting until it returns
+func (db *DB) exclusive(fn func() error) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	return db.runExclusive(fn)
+}
+
+// runExclusive is exclusive for callers holding db.mu
+func (db *DB) runExclusive(fn func() error) error {
+	w := &writer{cond: sync.NewCond(&db.mu)}
+	db.writers = append(db.writers, w)
+	for db.writers[0] != w {
+		w.cond.Wait()
+	}
+	err := fn()
+	db.finishWriters(w, err)
+	return err
+}
@@ -0,0 +1,106 @@
+package db
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+)
+
+func TestWriteBatch(t *testing.T) {
+	clearDir()
+
+	db, err := Open(testdbPath, opt)
+	assert.Nil(t, err)
+	b := NewWriteBatch()
+	b.Set([]byte("a"), []byte("1"))
+	b.Set([]byte("b"), []byte("2"))
+	b.Set([]byte("a"), []byte("3"))
+	assert.Equal(t, 3, b.Len())
+	assert.Nil(t, db.Write(b))
+	assert.Equal(t, uint64(3), db.seqNum)
+
+	b.Reset()
+	assert.Equal(t, 0, b.Len())
+	assert.Nil(t, db.Write(b))
+	db.Close()
+
+	db, err = Open(testdbPath, opt)
+	assert.Nil(t, err)
+	defer db.Close()
+	v, err := db.Get([]byte("a"))
+	assert.Nil(t, err)
+	assert.Equal(t, "3", string(v))
+	v, err = db.Get([]byte("b"))
+	assert.Nil(t, err)
+	assert.Equal(t, "2", string(v))
+}
+
+func TestBuildBatchGroup(t *testing.T) {
+	clearDir()
+
+	groupOpt := opt
+	groupOpt.MaxGroupSize = 100
+	db, err := Open(testdbPath, groupOpt)
+	assert.Nil(t, err)
+	defer db.Close()
+
+	newWriter := func(n int) *writer {
+		b := NewWriteBatch()
+		for i := 0; i < n; i++ {
+			b.Set([]byte(fmt.Sprint("key", i)), []byte("value"))
+		}
+		return &writer{batch: &b.batch}
+	}
+	// each record takes 1+1+4+1+5 = 12 bytes
+	w1, w2, w3, w4 := newWriter(2), newWriter(3), newWriter(1), newWriter(3)
+	db.writers = []*writer{w1, w2, w3, w4}
+	group, last := db.buildBatchGroup()
+	assert.Equal(t, w3, last)
+	assert.Equal(t, uint32(6), group.count())
+
+	// writers after an exclusive one are not grouped with the ones before
+	db.writers = []*writer{w1, {}, w2}
+	group, last = db.buildBatchGroup()
+	assert.Equal(t, w1, last)
+	assert.Equal(t, w1.batch, group)
+	db.writers = nil
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	clearDir()
+
+	syncOpt := Opt{maxMemorySize: 2000, SyncWrites: true}
+	db, err := Open(testdbPath, syncOpt)
+	assert.Nil(t, err)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				key := []byte(fmt.Sprintf("key%d-%d", g, i))
+				assert.Nil(t, db.Set(key, key))
+				v, err := db.Get(key)
+				assert.Nil(t, err)
+				assert.Equal(t, string(key), string(v))
+			}
+		}(g)
+	}
+	wg.Wait()
+	assert.Equal(t, uint64(8*50), db.seqNum)
+	db.Close()
+
+	db, err = Open(testdbPath, syncOpt)
+	assert.Nil(t, err)
+	defer db.Close()
+	for g := 0; g < 8; g++ {
+		for i := 0; i < 50; i++ {
+			key := fmt.Sprintf("key%d-%d", g, i)
+			v, err := db.Get([]byte(key))
+			assert.Nil(t, err)
+			assert.Equal(t, key, string(v))
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package memdb
+
+import (
+	"math"
+	"sync/atomic"
+	"unsafe"
+)
+
+// arena hands out offsets into a single byte slice holding every node, key and value of
+// a MemDB, so that the skiplist does not allocate per entry and holds no pointers.
+// When the slice is full it is copied into a larger one. Offsets stay valid across the
+// copy, readers that still hold the old slice just don't see later writes.
+// Only one goroutine may allocate at a time
+type arena struct {
+	buf atomic.Pointer[[]byte]
+	n   atomic.Uint32
+}
+
+const (
+	initialArenaSize = 64 << 10
+	// the partitions of a hashPrefix memtable start small, as there may be many of them
+	bucketArenaSize = 1 << 10
+	nodeAlign       = 8
+)
+
+// maxNodeSize bytes must follow every node offset, so that a *node never points past
+// the end of the slice, whatever the height of the node
+var maxNodeSize = uint32(unsafe.Sizeof(node{}))
+
+func newArena(size int) *arena {
+	a := &arena{}
+	buf := make([]byte, size)
+	a.buf.Store(&buf)
+	// offset 0 is used as the nil node
+	a.n.Store(nodeAlign)
+	return a
+}
+
+func (a *arena) bytes() []byte {
+	return *a.buf.Load()
+}
+
+func (a *arena) size() uint32 {
+	return a.n.Load()
+}
+
+// alloc reserves size bytes aligned to align, with room for extra bytes after them
+func (a *arena) alloc(size, align, extra uint32) uint32 {
+	offset := (a.n.Load() + align - 1) &^ (align - 1)
+	end := uint64(offset) + uint64(size)
+	if end+uint64(extra) > math.MaxUint32 {
+		panic("memdb: arena is full")
+	}
+	buf := a.bytes()
+	if end+uint64(extra) > uint64(len(buf)) {
+		newSize := 2 * uint64(len(buf))
+		for newSize < end+uint64(extra) {
+			newSize *= 2
+		}
+		if newSize > math.MaxUint32 {
+			newSize = math.MaxUint32
+		}
+		newBuf := make([]byte, newSize)
+		copy(newBuf, buf[:a.n.Load()])
+		a.buf.Store(&newBuf)
+	}
+	a.n.Store(uint32(end))
+	return offset
+}
+
+// allocBytes copies b into the arena and returns its offset
+func (a *arena) allocBytes(b []byte) uint32 {
+	offset := a.alloc(uint32(len(b)), 1, 0)
+	copy(a.bytes()[offset:], b)
+	return offset
+}
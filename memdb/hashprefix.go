@@ -0,0 +1,180 @@
+package memdb
+
+import (
+	"container/heap"
+	"errors"
+	"leveldb_go/util"
+	"sort"
+	"sync"
+)
+
+// HashPrefix returns a factory for memtables that partition entries by the first
+// prefixLen bytes of their user keys. Each partition is a skiplist found through a hash
+// map, so point lookups only search the entries sharing their prefix. Iterating merges
+// all partitions, which is slower than with a single skiplist
+func HashPrefix(prefixLen int) Factory {
+	return func(cmp util.Comparator) MemTable {
+		return &hashPrefix{
+			cmp:       cmp,
+			prefixLen: prefixLen,
+			buckets:   make(map[string]*MemDB),
+		}
+	}
+}
+
+type hashPrefix struct {
+	cmp       util.Comparator
+	prefixLen int
+
+	mu      sync.RWMutex
+	buckets map[string]*MemDB
+}
+
+func (h *hashPrefix) prefix(ikey util.IKey) string {
+	key := ikey.Key()
+	if len(key) > h.prefixLen {
+		key = key[:h.prefixLen]
+	}
+	return string(key)
+}
+
+func (h *hashPrefix) Add(ikey util.IKey, value []byte) {
+	prefix := h.prefix(ikey)
+	h.mu.RLock()
+	bucket, ok := h.buckets[prefix]
+	h.mu.RUnlock()
+	if !ok {
+		h.mu.Lock()
+		// another Add may have created the bucket since it was looked up
+		bucket, ok = h.buckets[prefix]
+		if !ok {
+			bucket = newMemDB(h.cmp, bucketArenaSize)
+			h.buckets[prefix] = bucket
+		}
+		h.mu.Unlock()
+	}
+	bucket.Put(ikey, value)
+}
+
+func (h *hashPrefix) Get(ikey util.IKey) ([]byte, bool) {
+	h.mu.RLock()
+	bucket, ok := h.buckets[h.prefix(ikey)]
+	h.mu.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	return bucket.GetIKey(ikey)
+}
+
+func (h *hashPrefix) ApproximateMemoryUsage() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	size := 0
+	for prefix, bucket := range h.buckets {
+		// the head node of every bucket counts as well, unlike in a single skiplist
+		size += len(prefix) + int(bucket.arena.size())
+	}
+	return size
+}
+
+// NewIterator merges the partitions that exist when it is created
+func (h *hashPrefix) NewIterator() Iterator {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	prefixes := make([]string, 0, len(h.buckets))
+	for prefix := range h.buckets {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	it := &mergingIter{cmp: h.cmp}
+	for _, prefix := range prefixes {
+		it.iters = append(it.iters, h.buckets[prefix].Iterator())
+	}
+	return it
+}
+
+// mergingIter yields the entries of several iterators in order, using a heap of the
+// iterators that are not exhausted
+type mergingIter struct {
+	cmp     util.Comparator
+	iters   []*MemDBIter
+	h       iterHeap
+	started bool
+}
+
+type iterHeap struct {
+	cmp   util.Comparator
+	iters []*MemDBIter
+}
+
+func (h iterHeap) Len() int {
+	return len(h.iters)
+}
+
+func (h iterHeap) Less(i, j int) bool {
+	return h.cmp.Compare(h.iters[i].Key(), h.iters[j].Key()) < 0
+}
+
+func (h iterHeap) Swap(i, j int) {
+	h.iters[i], h.iters[j] = h.iters[j], h.iters[i]
+}
+
+func (h *iterHeap) Push(x interface{}) {
+	h.iters = append(h.iters, x.(*MemDBIter))
+}
+
+func (h *iterHeap) Pop() interface{} {
+	it := h.iters[len(h.iters)-1]
+	h.iters = h.iters[:len(h.iters)-1]
+	return it
+}
+
+func (m *mergingIter) reset(position func(it *MemDBIter) bool) {
+	m.h = iterHeap{cmp: m.cmp}
+	for _, it := range m.iters {
+		if position(it) {
+			m.h.iters = append(m.h.iters, it)
+		}
+	}
+	heap.Init(&m.h)
+	m.started = true
+}
+
+func (m *mergingIter) Next() error {
+	if !m.started {
+		m.reset(func(it *MemDBIter) bool {
+			return it.Next() == nil
+		})
+	} else if m.h.Len() > 0 {
+		if m.h.iters[0].Next() == nil {
+			heap.Fix(&m.h, 0)
+		} else {
+			heap.Pop(&m.h)
+		}
+	}
+	if m.h.Len() == 0 {
+		return errors.New("eof")
+	}
+	return nil
+}
+
+func (m *mergingIter) Seek(key []byte) bool {
+	m.reset(func(it *MemDBIter) bool {
+		return it.Seek(key)
+	})
+	return m.h.Len() > 0
+}
+
+func (m *mergingIter) Key() []byte {
+	if m.h.Len() == 0 {
+		return nil
+	}
+	return m.h.iters[0].Key()
+}
+
+func (m *mergingIter) Value() []byte {
+	if m.h.Len() == 0 {
+		return nil
+	}
+	return m.h.iters[0].Value()
+}
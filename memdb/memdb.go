@@ -5,151 +5,205 @@ import (
 	"errors"
 	"leveldb_go/util"
 	"math/rand"
+	"sync/atomic"
+	"unsafe"
 )
 
 const maxHeight = 12
 
+// MemDB is a skiplist kept in an arena. Readers never block and may run concurrently
+// with one writer, Put and Delete calls have to be serialized by the caller
 type MemDB struct {
-	head *node
-	cmp  util.Comparator
-	size int
+	arena  *arena
+	head   uint32
+	height atomic.Uint32
+	cmp    util.Comparator
+	// arena bytes used by an empty MemDB
+	base uint32
 }
 
 func NewMemDB(cmp util.Comparator) *MemDB {
-	return &MemDB{
-		head: newNode(maxHeight),
-		cmp:  cmp,
+	return newMemDB(cmp, initialArenaSize)
+}
+
+func newMemDB(cmp util.Comparator, arenaSize int) *MemDB {
+	m := &MemDB{
+		arena: newArena(arenaSize),
+		cmp:   cmp,
 	}
+	m.head = m.newNode(maxHeight, nil, nil)
+	m.height.Store(1)
+	m.base = m.arena.size()
+	return m
 }
 
-func (m *MemDB) Put(key, value []byte) {
-	insertNode(m.head, m.cmp, key, value)
-	m.size += len(key) + len(value)
+// node is the header of a skiplist entry. Nodes live in the arena and link to each
+// other by offset, only the first height entries of tower are allocated
+type node struct {
+	// value offset << 32 | value length, replaced atomically when a key is overwritten
+	value     uint64
+	keyOffset uint32
+	keySize   uint32
+	deleted   uint32
+	tower     [maxHeight]uint32
 }
 
-func (m *MemDB) Delete(key []byte) {
-	n, exact := findNode(m.head, m.cmp, key, nil)
-	if exact {
-		n.deleted = true
-	}
+func (m *MemDB) newNode(height int, key, value []byte) uint32 {
+	keyOffset := m.arena.allocBytes(key)
+	valueOffset := m.arena.allocBytes(value)
+	size := maxNodeSize - uint32(maxHeight-height)*4
+	offset := m.arena.alloc(size, nodeAlign, maxNodeSize-size)
+
+	n := getNode(m.arena.bytes(), offset)
+	n.value = uint64(valueOffset)<<32 | uint64(len(value))
+	n.keyOffset = keyOffset
+	n.keySize = uint32(len(key))
+	return offset
 }
 
-// Get /* do not use */
-func (m *MemDB) Get(key []byte) ([]byte, bool) {
-	n, exact := findNode(m.head, m.cmp, key, nil)
-	if !exact || n.deleted {
-		return nil, false
-	}
-	return n.value, true
+func getNode(buf []byte, offset uint32) *node {
+	return (*node)(unsafe.Pointer(&buf[offset]))
 }
 
-func (m *MemDB) GetIKey(ikey util.IKey) ([]byte, bool) {
-	n, _ := findNode(m.head, m.cmp, ikey, nil)
-	if n == m.head {
-		return nil, false
-	}
-	ikey2 := util.IKey(n.key)
+func (n *node) key(buf []byte) []byte {
+	return buf[n.keyOffset : n.keyOffset+n.keySize : n.keyOffset+n.keySize]
+}
 
-	if ikey2.KeyType() == util.IKeyTypeDelete || !bytes.Equal(ikey.Key(), ikey2.Key()) {
-		return nil, false
-	}
+func (n *node) val(buf []byte) []byte {
+	v := atomic.LoadUint64(&n.value)
+	offset, size := uint32(v>>32), uint32(v)
+	return buf[offset : offset+size : offset+size]
+}
 
-	return n.value, true
+func (n *node) next(level int) uint32 {
+	return atomic.LoadUint32(&n.tower[level])
 }
 
-func (m *MemDB) ApproxSize() int {
-	return m.size
+func (n *node) isDeleted() bool {
+	return atomic.LoadUint32(&n.deleted) == 1
 }
 
-type node struct {
-	nextNode []*node
-	prevNode []*node
-	key      []byte
-	value    []byte
-	deleted  bool
-}
-
-func newNode(height int) *node {
-	return &node{
-		prevNode: make([]*node, height),
-		nextNode: make([]*node, height),
-	}
-}
-
-func findNode(head *node, cmp util.Comparator, key []byte, prev *[maxHeight]*node) (*node, bool) {
-	height := len(head.nextNode) - 1
-	current := head
-	for height >= 0 {
-		candidate := current.nextNode[height]
-		if candidate == nil {
-			if prev != nil {
-				prev[height] = current
-			}
-			height--
+// findGreaterOrEqual returns the first node with a key >= key, or 0 if there is none.
+// If prev is set, it is filled with the last node before key at every level
+func (m *MemDB) findGreaterOrEqual(buf []byte, key []byte, prev *[maxHeight]uint32) uint32 {
+	x := m.head
+	level := int(m.height.Load()) - 1
+	for {
+		next := getNode(buf, x).next(level)
+		if next != 0 && m.cmp.Compare(getNode(buf, next).key(buf), key) < 0 {
+			x = next
 			continue
 		}
-		result := cmp.Compare(candidate.key, key)
-		if result == 0 {
-			if prev != nil {
-				for h := 0; h <= height; h++ {
-					prev[height] = candidate
-				}
-			}
-			return candidate, true
+		if prev != nil {
+			prev[level] = x
 		}
-		if result > 0 {
-			if prev != nil {
-				prev[height] = current
-			}
-			if height == 0 {
-				return candidate, false
-			}
-			height--
-			continue
+		if level == 0 {
+			return next
 		}
-		current = candidate
-
+		level--
 	}
-	return current, false
 }
 
-// need to add node type as well (tombstone deletion)
+// findExact returns the node holding key, or 0
+func (m *MemDB) findExact(buf []byte, key []byte) uint32 {
+	n := m.findGreaterOrEqual(buf, key, nil)
+	if n == 0 || m.cmp.Compare(getNode(buf, n).key(buf), key) != 0 {
+		return 0
+	}
+	return n
+}
 
-func insertNode(head *node, cmp util.Comparator, key []byte, value []byte) {
-	// TODO inefficient buffer allocation
-	k := make([]byte, len(key))
-	copy(k, key)
-	v := make([]byte, len(value))
-	copy(v, value)
-	var prev [maxHeight]*node
-	position, exactMatch := findNode(head, cmp, key, &prev)
+func randomHeight() int {
+	h := 1
+	for h < maxHeight && rand.Intn(4) == 0 {
+		h++
+	}
+	return h
+}
 
-	if exactMatch {
-		position.value = v
-		position.deleted = false
+// Put inserts key, replacing the value if key is already present
+func (m *MemDB) Put(key, value []byte) {
+	var prev [maxHeight]uint32
+	buf := m.arena.bytes()
+	x := m.findGreaterOrEqual(buf, key, &prev)
+	if x != 0 && m.cmp.Compare(getNode(buf, x).key(buf), key) == 0 {
+		valueOffset := m.arena.allocBytes(value)
+		n := getNode(m.arena.bytes(), x)
+		atomic.StoreUint64(&n.value, uint64(valueOffset)<<32|uint64(len(value)))
+		atomic.StoreUint32(&n.deleted, 0)
 		return
 	}
-	h := 1
-	for ; h < maxHeight; h++ {
-		if rand.Int()%4 != 0 {
-			break
-		}
-	}
 
-	newNode := newNode(h)
-	newNode.key = k
-	newNode.value = v
+	h := randomHeight()
+	height := int(m.height.Load())
+	for i := height; i < h; i++ {
+		prev[i] = m.head
+	}
 
+	offset := m.newNode(h, key, value)
+	// the arena may have grown, the links have to be written into the current slice
+	buf = m.arena.bytes()
+	n := getNode(buf, offset)
+	for i := 0; i < h; i++ {
+		n.tower[i] = getNode(buf, prev[i]).next(i)
+	}
+	if h > height {
+		m.height.Store(uint32(h))
+	}
+	// publish bottom up, a reader may see the node at lower levels first
 	for i := 0; i < h; i++ {
-		newNode.prevNode[i] = prev[i]
-		newNode.nextNode[i] = prev[i].nextNode[i]
-		prev[i].nextNode[i] = newNode
+		atomic.StoreUint32(&getNode(buf, prev[i]).tower[i], offset)
+	}
+}
+
+// Delete hides key, Put makes it visible again
+func (m *MemDB) Delete(key []byte) {
+	buf := m.arena.bytes()
+	x := m.findExact(buf, key)
+	if x != 0 {
+		atomic.StoreUint32(&getNode(buf, x).deleted, 1)
+	}
+}
+
+// Get /* do not use */
+func (m *MemDB) Get(key []byte) ([]byte, bool) {
+	buf := m.arena.bytes()
+	x := m.findExact(buf, key)
+	if x == 0 || getNode(buf, x).isDeleted() {
+		return nil, false
+	}
+	return getNode(buf, x).val(buf), true
+}
+
+func (m *MemDB) GetIKey(ikey util.IKey) ([]byte, bool) {
+	buf := m.arena.bytes()
+	x := m.findGreaterOrEqual(buf, ikey, nil)
+	for x != 0 && getNode(buf, x).isDeleted() {
+		x = getNode(buf, x).next(0)
+	}
+	if x == 0 {
+		return nil, false
+	}
+	n := getNode(buf, x)
+	ikey2 := util.IKey(n.key(buf))
+
+	if ikey2.KeyType() == util.IKeyTypeDelete || !bytes.Equal(ikey.Key(), ikey2.Key()) {
+		return nil, false
 	}
+
+	return n.val(buf), true
+}
+
+// ApproxSize returns the number of arena bytes used by the entries, including their
+// nodes and overwritten values
+func (m *MemDB) ApproxSize() int {
+	return int(m.arena.size() - m.base)
 }
 
 type MemDBIter struct {
 	m           *MemDB
-	currentNode *node
+	currentNode uint32
+	buf         []byte
 }
 
 func (m *MemDB) Iterator() *MemDBIter {
@@ -158,39 +212,45 @@ func (m *MemDB) Iterator() *MemDBIter {
 		currentNode: m.head,
 	}
 }
+
 func (i *MemDBIter) Key() []byte {
-	if i.currentNode == nil {
+	if i.currentNode == 0 || i.currentNode == i.m.head {
 		return nil
 	}
-	return i.currentNode.key
+	return getNode(i.buf, i.currentNode).key(i.buf)
 }
 
 func (i *MemDBIter) Value() []byte {
-	if i.currentNode == nil {
+	if i.currentNode == 0 || i.currentNode == i.m.head {
 		return nil
 	}
-	return i.currentNode.value
+	return getNode(i.buf, i.currentNode).val(i.buf)
 }
 
+// Seek moves to the first entry with a key >= key and reports whether there is one
 func (i *MemDBIter) Seek(key []byte) bool {
-	n, exact := findNode(i.m.head, i.m.cmp, key, nil)
-	i.currentNode = n
-	if exact && n.deleted == false {
-		return true
-	}
-	return i.Next() == nil
+	i.buf = i.m.arena.bytes()
+	i.currentNode = i.m.findGreaterOrEqual(i.buf, key, nil)
+	i.skipDeleted()
+	return i.currentNode != 0
 }
 
 func (i *MemDBIter) Next() error {
-	for i.currentNode != nil {
-		i.currentNode = i.currentNode.nextNode[0]
-
-		if i.currentNode == nil || !i.currentNode.deleted {
-			break
-		}
+	if i.currentNode == 0 {
+		return errors.New("eof")
 	}
-	if i.currentNode == nil {
+	// reload the arena, offsets stay valid if it has grown
+	i.buf = i.m.arena.bytes()
+	i.currentNode = getNode(i.buf, i.currentNode).next(0)
+	i.skipDeleted()
+	if i.currentNode == 0 {
 		return errors.New("eof")
 	}
 	return nil
 }
+
+func (i *MemDBIter) skipDeleted() {
+	for i.currentNode != 0 && getNode(i.buf, i.currentNode).isDeleted() {
+		i.currentNode = getNode(i.buf, i.currentNode).next(0)
+	}
+}
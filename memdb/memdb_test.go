@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"leveldb_go/util"
+	"math/rand"
+	"sync"
 	"testing"
 )
 
@@ -159,3 +161,84 @@ func TestMemDB_SeekLarge(t *testing.T) {
 	iter.Seek([]byte("key823"))
 	assert.Equal(t, "value823", string(iter.Value()))
 }
+
+func TestMemDB_ArenaGrowth(t *testing.T) {
+	m := NewMemDB(cmp)
+	assert.Equal(t, 0, m.ApproxSize())
+
+	value := make([]byte, 1000)
+	for i := 0; i < 500; i++ {
+		m.Put([]byte(fmt.Sprintf("key%03d", i)), value)
+	}
+	// every entry takes its key, value and a node
+	assert.True(t, m.ApproxSize() >= 500*(6+1000+16))
+	assert.True(t, len(m.arena.bytes()) > initialArenaSize)
+
+	// overwriting allocates the new value
+	size := m.ApproxSize()
+	m.Put([]byte("key000"), []byte("small"))
+	assert.Equal(t, size+len("small"), m.ApproxSize())
+	v, ok := m.Get([]byte("key000"))
+	assert.True(t, ok)
+	assert.Equal(t, "small", string(v))
+
+	iter := m.Iterator()
+	i := 0
+	for ; iter.Next() == nil; i++ {
+		assert.Equal(t, fmt.Sprintf("key%03d", i), string(iter.Key()))
+	}
+	assert.Equal(t, 500, i)
+}
+
+func TestMemDB_ConcurrentReaders(t *testing.T) {
+	m := NewMemDB(cmp)
+	const n = 5000
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				// whatever is visible must be sorted and complete
+				iter := m.Iterator()
+				var last []byte
+				for iter.Next() == nil {
+					key := iter.Key()
+					if last != nil && cmp.Compare(last, key) >= 0 {
+						t.Errorf("keys out of order: %s %s", last, key)
+						return
+					}
+					if string(iter.Value()) != "value"+string(key[3:]) {
+						t.Errorf("wrong value for %s: %s", key, iter.Value())
+						return
+					}
+					last = append(last[:0], key...)
+				}
+				k := fmt.Sprintf("key%05d", rand.Intn(n))
+				if v, ok := m.Get([]byte(k)); ok && string(v) != "value"+k[3:] {
+					t.Errorf("wrong value for %s: %s", k, v)
+					return
+				}
+			}
+		}()
+	}
+
+	for _, i := range rand.Perm(n) {
+		m.Put([]byte(fmt.Sprintf("key%05d", i)), []byte(fmt.Sprintf("value%05d", i)))
+	}
+	close(done)
+	wg.Wait()
+
+	for i := 0; i < n; i++ {
+		v, ok := m.Get([]byte(fmt.Sprintf("key%05d", i)))
+		assert.True(t, ok)
+		assert.Equal(t, fmt.Sprintf("value%05d", i), string(v))
+	}
+}
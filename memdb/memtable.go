@@ -0,0 +1,55 @@
+package memdb
+
+import (
+	"leveldb_go/util"
+)
+
+// MemTable buffers internal keys in memory until they are written to a table
+type MemTable interface {
+	// Add inserts ikey. Adding an ikey twice replaces its value
+	Add(ikey util.IKey, value []byte)
+	// Get returns the value of the newest entry for the user key of ikey that is not
+	// newer than ikey, false if there is none or it is a deletion
+	Get(ikey util.IKey) ([]byte, bool)
+	// NewIterator returns an iterator over all entries in key order
+	NewIterator() Iterator
+	// ApproximateMemoryUsage returns the bytes held by the entries
+	ApproximateMemoryUsage() int
+}
+
+// Iterator walks the entries of a MemTable. It starts before the first entry
+type Iterator interface {
+	Next() error
+	// Seek moves to the first entry with a key >= key and reports whether there is one
+	Seek(key []byte) bool
+	Key() []byte
+	Value() []byte
+}
+
+// Factory creates empty memtables ordered by cmp
+type Factory func(cmp util.Comparator) MemTable
+
+// NewSkipList returns the default memtable, a MemDB
+func NewSkipList(cmp util.Comparator) MemTable {
+	return skipList{NewMemDB(cmp)}
+}
+
+type skipList struct {
+	*MemDB
+}
+
+func (s skipList) Add(ikey util.IKey, value []byte) {
+	s.Put(ikey, value)
+}
+
+func (s skipList) Get(ikey util.IKey) ([]byte, bool) {
+	return s.GetIKey(ikey)
+}
+
+func (s skipList) NewIterator() Iterator {
+	return s.Iterator()
+}
+
+func (s skipList) ApproximateMemoryUsage() int {
+	return s.ApproxSize()
+}
@@ -0,0 +1,89 @@
+package memdb
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"leveldb_go/util"
+	"math/rand"
+	"testing"
+)
+
+var factories = map[string]Factory{
+	"skiplist":   NewSkipList,
+	"vector":     NewVector,
+	"hashprefix": HashPrefix(4),
+}
+
+func TestMemTables(t *testing.T) {
+	for name, factory := range factories {
+		t.Run(name, func(t *testing.T) {
+			m := factory(util.IKeyStringCmp)
+			assert.Equal(t, 0, m.ApproximateMemoryUsage())
+
+			var keys []string
+			for i := 0; i < 500; i++ {
+				keys = append(keys, fmt.Sprintf("k%02d-%03d", i%7, i))
+			}
+			for i, idx := range rand.Perm(len(keys)) {
+				m.Add(util.CreateIKey([]byte(keys[idx]), util.IKeyTypeSet, uint64(i+1)), []byte("v1-"+keys[idx]))
+			}
+			// newer versions of some keys, and a deletion
+			m.Add(util.CreateIKey([]byte(keys[3]), util.IKeyTypeSet, 1000), []byte("v2"))
+			m.Add(util.CreateIKey([]byte(keys[4]), util.IKeyTypeDelete, 1001), nil)
+			assert.True(t, m.ApproximateMemoryUsage() > 0)
+
+			for i, key := range keys {
+				v, ok := m.Get(util.CreateIKey([]byte(key), util.IKeyTypeSet, 2000))
+				switch i {
+				case 3:
+					assert.True(t, ok)
+					assert.Equal(t, "v2", string(v))
+				case 4:
+					assert.False(t, ok)
+				default:
+					assert.True(t, ok)
+					assert.Equal(t, "v1-"+key, string(v))
+				}
+			}
+			// reads at an older sequence number don't see the newer version
+			v, ok := m.Get(util.CreateIKey([]byte(keys[3]), util.IKeyTypeSet, 999))
+			assert.True(t, ok)
+			assert.Equal(t, "v1-"+keys[3], string(v))
+			_, ok = m.Get(util.CreateIKey([]byte("missing"), util.IKeyTypeSet, 2000))
+			assert.False(t, ok)
+
+			it := m.NewIterator()
+			var last []byte
+			n := 0
+			for ; it.Next() == nil; n++ {
+				if last != nil {
+					assert.True(t, util.IKeyStringCmp.Compare(last, it.Key()) < 0)
+				}
+				last = append(last[:0], it.Key()...)
+			}
+			assert.Equal(t, len(keys)+2, n)
+
+			assert.True(t, it.Seek(util.CreateIKey([]byte("k03-01"), util.IKeyTypeSet, 2000)))
+			assert.Equal(t, "k03-010", string(util.IKey(it.Key()).Key()))
+			assert.Nil(t, it.Next())
+			assert.Equal(t, "k03-017", string(util.IKey(it.Key()).Key()))
+			assert.False(t, it.Seek(util.CreateIKey([]byte("z"), util.IKeyTypeSet, 2000)))
+		})
+	}
+}
+
+func TestHashPrefixManyPrefixes(t *testing.T) {
+	m := HashPrefix(4)(util.IKeyStringCmp).(*hashPrefix)
+	for i := 0; i < 1000; i++ {
+		m.Add(util.CreateIKey([]byte(fmt.Sprintf("%04d", i)), util.IKeyTypeSet, uint64(i+1)), []byte("v"))
+	}
+	assert.Equal(t, 1000, len(m.buckets))
+	// every bucket keeps its small arena, so the usage reported is not far below the
+	// memory allocated
+	allocated := 0
+	for _, bucket := range m.buckets {
+		allocated += len(bucket.arena.bytes())
+	}
+	assert.Equal(t, 1000*bucketArenaSize, allocated)
+	assert.True(t, m.ApproximateMemoryUsage() > allocated/8)
+}
@@ -0,0 +1,134 @@
+package memdb
+
+import (
+	"bytes"
+	"errors"
+	"leveldb_go/util"
+	"sort"
+	"sync"
+)
+
+// per entry bookkeeping of the vector memtable, two slice headers
+const vectorEntryOverhead = 48
+
+// NewVector returns a memtable that appends entries to a slice and only sorts them when
+// they are read. Adds are cheap, which suits bulk loads that are read after the flush,
+// but reads after every write sort again
+func NewVector(cmp util.Comparator) MemTable {
+	return &vector{cmp: cmp}
+}
+
+type vector struct {
+	mu      sync.Mutex
+	cmp     util.Comparator
+	entries []vectorEntry
+	sorted  bool
+	size    int
+}
+
+type vectorEntry struct {
+	key, value []byte
+}
+
+func (v *vector) Add(ikey util.IKey, value []byte) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.entries = append(v.entries, vectorEntry{
+		key:   append([]byte{}, ikey...),
+		value: append([]byte{}, value...),
+	})
+	v.sorted = false
+	v.size += len(ikey) + len(value) + vectorEntryOverhead
+}
+
+// sort orders the entries, keeping only the last added value of equal keys.
+// v.mu must be held
+func (v *vector) sort() []vectorEntry {
+	if v.sorted {
+		return v.entries
+	}
+	// sort a copy, iterators may still hold the current slice
+	entries := append([]vectorEntry{}, v.entries...)
+	sort.SliceStable(entries, func(i, j int) bool {
+		return v.cmp.Compare(entries[i].key, entries[j].key) < 0
+	})
+	v.entries = entries[:0]
+	for i, e := range entries {
+		if i+1 < len(entries) && v.cmp.Compare(e.key, entries[i+1].key) == 0 {
+			continue
+		}
+		v.entries = append(v.entries, e)
+	}
+	v.sorted = true
+	return v.entries
+}
+
+func (v *vector) search(entries []vectorEntry, key []byte) int {
+	return sort.Search(len(entries), func(i int) bool {
+		return v.cmp.Compare(entries[i].key, key) >= 0
+	})
+}
+
+func (v *vector) Get(ikey util.IKey) ([]byte, bool) {
+	v.mu.Lock()
+	entries := v.sort()
+	v.mu.Unlock()
+
+	i := v.search(entries, ikey)
+	if i == len(entries) {
+		return nil, false
+	}
+	ikey2 := util.IKey(entries[i].key)
+	if ikey2.KeyType() == util.IKeyTypeDelete || !bytes.Equal(ikey.Key(), ikey2.Key()) {
+		return nil, false
+	}
+	return entries[i].value, true
+}
+
+// NewIterator sorts the entries. The iterator does not see entries added after it was created
+func (v *vector) NewIterator() Iterator {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return &vectorIter{v: v, entries: v.sort(), i: -1}
+}
+
+func (v *vector) ApproximateMemoryUsage() int {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.size
+}
+
+type vectorIter struct {
+	v       *vector
+	entries []vectorEntry
+	i       int
+}
+
+func (it *vectorIter) Next() error {
+	if it.i < len(it.entries) {
+		it.i++
+	}
+	if it.i == len(it.entries) {
+		return errors.New("eof")
+	}
+	return nil
+}
+
+func (it *vectorIter) Seek(key []byte) bool {
+	it.i = it.v.search(it.entries, key)
+	return it.i < len(it.entries)
+}
+
+func (it *vectorIter) Key() []byte {
+	if it.i < 0 || it.i >= len(it.entries) {
+		return nil
+	}
+	return it.entries[it.i].key
+}
+
+func (it *vectorIter) Value() []byte {
+	if it.i < 0 || it.i >= len(it.entries) {
+		return nil
+	}
+	return it.entries[it.i].value
+}
@@ -92,6 +92,19 @@ func (w *Writer) Flush() error {
 	return nil
 }
 
+// Sync flushes the buffered data and commits it to stable storage
+// if the underlying writer supports it
+func (w *Writer) Sync() error {
+	err := w.Flush()
+	if err != nil {
+		return err
+	}
+	if s, ok := w.w.(interface{ Sync() error }); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
 func (w *Writer) Close() error {
 	if w.offset > 0 {
 		w.finishBlock()
@@ -113,6 +126,9 @@ type Reader struct {
 	buf    [chunkSize]byte
 	offset int
 	size   int
+	// pos is the offset of buf in r, end the offset right after the last record read
+	pos int64
+	end int64
 }
 
 func NewReader(r io.Reader) *Reader {
@@ -121,11 +137,34 @@ func NewReader(r io.Reader) *Reader {
 	}
 }
 
+// NewReaderAt returns a Reader starting at offset in r, which must be the end of a record
+// as returned by Offset. It is used to read the records appended since a previous Reader
+func NewReaderAt(r io.ReadSeeker, offset int64) (*Reader, error) {
+	_, err := r.Seek(offset, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{
+		r:   r,
+		pos: offset,
+		end: offset,
+	}, nil
+}
+
+// Offset returns the offset in the underlying reader right after the last record read
+func (r *Reader) Offset() int64 {
+	return r.end
+}
+
+// readBlock reads up to the end of the current block, which is only part of a block
+// when the Reader started within one or the writer has not finished it yet
 func (r *Reader) readBlock() error {
-	size, err := r.r.Read(r.buf[:])
+	next := r.pos + int64(r.size)
+	size, err := r.r.Read(r.buf[:chunkSize-int(next%chunkSize)])
 	if err != nil {
 		return err
 	}
+	r.pos = next
 	r.offset = 0
 	r.size = size
 	return nil
@@ -139,7 +178,7 @@ func (r *Reader) ReadBlock() ([]byte, error) {
 	var data []byte
 	first := true
 	for {
-		if r.size-r.offset < blockHeaderSize || r.buf[r.offset+6] == 0 {
+		for r.size-r.offset < blockHeaderSize || r.buf[r.offset+6] == 0 {
 			err := r.readBlock()
 			if err != nil {
 				return nil, err
@@ -147,6 +186,21 @@ func (r *Reader) ReadBlock() ([]byte, error) {
 		}
 		chunkType := r.buf[r.offset+6]
 		chunkLen := binary.LittleEndian.Uint16(r.buf[r.offset+4:])
+		if r.offset+blockHeaderSize+int(chunkLen) > r.size {
+			// truncated chunk, usually a torn write at the end of the log
+			if (r.pos+int64(r.size))%chunkSize != 0 {
+				// the block was still being written when it was read, the rest of the
+				// chunk may follow. A later Reader resumes at Offset
+				return nil, io.EOF
+			}
+			first = true
+			data = data[:0]
+			err := r.readBlock()
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
 
 		if first && chunkType != firstChunkType && chunkType != fullChunkType {
 			first = true
@@ -189,6 +243,7 @@ func (r *Reader) ReadBlock() ([]byte, error) {
 		r.offset += blockHeaderSize + int(chunkLen)
 
 		if chunkType == lastChunkType || chunkType == fullChunkType {
+			r.end = r.pos + int64(r.offset)
 			return data, nil
 		}
 	}
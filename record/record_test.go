@@ -3,6 +3,7 @@ package record
 import (
 	"bytes"
 	"github.com/stretchr/testify/assert"
+	"io"
 	"strings"
 	"testing"
 )
@@ -55,3 +56,37 @@ func TestBoundary(t *testing.T) {
 	r3, _ := reader.ReadBlock()
 	assert.Equal(t, third, string(r3))
 }
+
+func TestReaderAt(t *testing.T) {
+	var buf closeableBuffer
+	writer := NewWriter(&buf)
+	writer.Write([]byte(blob("a", 20000)))
+	writer.Flush()
+	first := len(buf.Bytes())
+	writer.Write([]byte(blob("b", 20000)))
+	writer.Write([]byte(blob("c", 100)))
+	writer.Flush()
+	full := buf.Bytes()
+
+	// part of the first chunk of b, as seen while the writer is still writing it
+	reader := NewReader(bytes.NewReader(full[:first+100]))
+	r1, err := reader.ReadBlock()
+	assert.Nil(t, err)
+	assert.Equal(t, blob("a", 20000), string(r1))
+	_, err = reader.ReadBlock()
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, int64(first), reader.Offset())
+
+	// the records appended since are read from the offset reached
+	reader, err = NewReaderAt(bytes.NewReader(full), reader.Offset())
+	assert.Nil(t, err)
+	r2, err := reader.ReadBlock()
+	assert.Nil(t, err)
+	assert.Equal(t, blob("b", 20000), string(r2))
+	r3, err := reader.ReadBlock()
+	assert.Nil(t, err)
+	assert.Equal(t, blob("c", 100), string(r3))
+	assert.Equal(t, int64(len(full)), reader.Offset())
+	_, err = reader.ReadBlock()
+	assert.Equal(t, io.EOF, err)
+}
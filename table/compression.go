@@ -0,0 +1,163 @@
+package table
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"fmt"
+	"github.com/golang/snappy"
+	"io"
+	"sync"
+)
+
+// Compressor compresses blocks. Its type is stored in the trailer of every block it
+// compressed, so readers can pick the compressor to decode it with
+type Compressor interface {
+	Type() byte
+	Name() string
+	Compress(dst, src []byte) ([]byte, error)
+	Decompress(src []byte) ([]byte, error)
+}
+
+const (
+	kZlibCompression  = 2
+	kFlateCompression = 8
+)
+
+var (
+	NoCompression     Compressor = noCompressor{}
+	SnappyCompression Compressor = snappyCompressor{}
+	ZlibCompression   Compressor = zlibCompressor{}
+	FlateCompression  Compressor = flateCompressor{}
+)
+
+var (
+	compressorsMu sync.RWMutex
+	compressors   = map[byte]Compressor{
+		kNoCompression:     NoCompression,
+		kSnappyCompression: SnappyCompression,
+		kZlibCompression:   ZlibCompression,
+		kFlateCompression:  FlateCompression,
+	}
+)
+
+// RegisterCompressor makes blocks of c.Type() readable. Types can't be registered twice
+func RegisterCompressor(c Compressor) error {
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+	if _, ok := compressors[c.Type()]; ok {
+		return fmt.Errorf("compression type %d is already registered", c.Type())
+	}
+	compressors[c.Type()] = c
+	return nil
+}
+
+// GetCompressor returns the compressor registered for a block type
+func GetCompressor(t byte) (Compressor, bool) {
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+	c, ok := compressors[t]
+	return c, ok
+}
+
+type noCompressor struct{}
+
+func (noCompressor) Type() byte {
+	return kNoCompression
+}
+
+func (noCompressor) Name() string {
+	return "none"
+}
+
+func (noCompressor) Compress(dst, src []byte) ([]byte, error) {
+	return src, nil
+}
+
+func (noCompressor) Decompress(src []byte) ([]byte, error) {
+	return src, nil
+}
+
+type snappyCompressor struct{}
+
+func (snappyCompressor) Type() byte {
+	return kSnappyCompression
+}
+
+func (snappyCompressor) Name() string {
+	return "snappy"
+}
+
+func (snappyCompressor) Compress(dst, src []byte) ([]byte, error) {
+	return snappy.Encode(dst, src), nil
+}
+
+func (snappyCompressor) Decompress(src []byte) ([]byte, error) {
+	return snappy.Decode(nil, src)
+}
+
+type zlibCompressor struct{}
+
+func (zlibCompressor) Type() byte {
+	return kZlibCompression
+}
+
+func (zlibCompressor) Name() string {
+	return "zlib"
+}
+
+func (zlibCompressor) Compress(dst, src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst[:0])
+	w := zlib.NewWriter(buf)
+	_, err := w.Write(src)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (zlibCompressor) Decompress(src []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+type flateCompressor struct{}
+
+func (flateCompressor) Type() byte {
+	return kFlateCompression
+}
+
+func (flateCompressor) Name() string {
+	return "flate"
+}
+
+func (flateCompressor) Compress(dst, src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst[:0])
+	w, err := flate.NewWriter(buf, flate.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write(src)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (flateCompressor) Decompress(src []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	return io.ReadAll(r)
+}
@@ -0,0 +1,88 @@
+package table
+
+import (
+	"leveldb_go/util"
+	"sync"
+	"syscall"
+)
+
+// MmapBudget bounds the number of bytes mapped by readers created with NewMmapReader.
+// It is safe for concurrent use
+type MmapBudget struct {
+	mu    sync.Mutex
+	limit int64
+	used  int64
+}
+
+// NewMmapBudget returns a budget allowing up to limit mapped bytes
+func NewMmapBudget(limit int64) *MmapBudget {
+	return &MmapBudget{limit: limit}
+}
+
+func (b *MmapBudget) reserve(n int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.used+n > b.limit {
+		return false
+	}
+	b.used += n
+	return true
+}
+
+func (b *MmapBudget) release(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= n
+}
+
+// Used returns the number of bytes currently mapped
+func (b *MmapBudget) Used() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.used
+}
+
+type fder interface {
+	Fd() uintptr
+}
+
+// NewMmapReader is like NewReader but maps the whole table into memory if reader is
+// backed by a file and budget has room for it, so that blocks are served from the
+// mapping. Otherwise the table is read with ReadAt.
+// Keys and values returned by a mapped reader are only valid until it is closed
+func NewMmapReader(reader RandomAccessReader, size int, cmp util.Comparator, budget *MmapBudget) (*Reader, error) {
+	f, ok := reader.(fder)
+	if !ok || size == 0 || !budget.reserve(int64(size)) {
+		return NewReader(reader, size, cmp)
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		budget.release(int64(size))
+		return NewReader(reader, size, cmp)
+	}
+
+	r, err := newReader(reader, size, cmp, data)
+	if err != nil {
+		syscall.Munmap(data)
+		budget.release(int64(size))
+		return nil, err
+	}
+	r.budget = budget
+	return r, nil
+}
+
+// Mapped reports whether the reader serves blocks from a mapping
+func (r *Reader) Mapped() bool {
+	return r.data != nil
+}
+
+// Close unmaps the table of a mapped reader. The underlying reader is not closed
+func (r *Reader) Close() error {
+	if r.data == nil {
+		return nil
+	}
+	err := syscall.Munmap(r.data)
+	r.budget.release(int64(len(r.data)))
+	r.data = nil
+	return err
+}
@@ -0,0 +1,153 @@
+package table
+
+import (
+	"encoding/binary"
+	"errors"
+	"leveldb_go/util"
+)
+
+// PropertiesNotFoundErr is returned by Reader.Properties for tables written without a
+// properties block
+var PropertiesNotFoundErr = errors.New("table has no properties block")
+
+// metaindex key of the properties block
+const propertiesBlockName = "leveldb.properties"
+
+// Properties describes the contents of a table. It is stored in a meta block so that it
+// can be read without scanning the table
+type Properties struct {
+	NumEntries   uint64
+	NumDeletions uint64 // only counted for internal keys
+	// range tombstones, they are kept in their own block and not counted in NumEntries
+	NumRangeDeletions uint64
+	RawKeySize        uint64
+	RawValueSize      uint64
+	DataSize          uint64 // size of the data blocks, including trailers
+	IndexSize         uint64 // uncompressed size of the index block
+	FilterSize        uint64
+	NumDataBlocks     uint64
+
+	Compression    string
+	ComparatorName string
+
+	// the range of sequence numbers, only set for internal keys
+	SmallestSeq uint64
+	LargestSeq  uint64
+
+	CreationTime int64 // seconds since the epoch
+}
+
+const (
+	propComparator    = "leveldb.comparator"
+	propCompression   = "leveldb.compression"
+	propCreationTime  = "leveldb.creation.time"
+	propDataSize      = "leveldb.data.size"
+	propFilterSize    = "leveldb.filter.size"
+	propIndexSize     = "leveldb.index.size"
+	propLargestSeq    = "leveldb.largest.seq"
+	propNumDataBlocks = "leveldb.num.data.blocks"
+	propNumDeletions  = "leveldb.num.deletions"
+	propNumEntries    = "leveldb.num.entries"
+	propNumRangeDels  = "leveldb.num.range-deletions"
+	propRawKeySize    = "leveldb.raw.key.size"
+	propRawValueSize  = "leveldb.raw.value.size"
+	propSmallestSeq   = "leveldb.smallest.seq"
+)
+
+// add updates the entry statistics with a key added to the table
+func (p *Properties) add(key, value []byte, internal bool) {
+	p.NumEntries++
+	p.RawKeySize += uint64(len(key))
+	p.RawValueSize += uint64(len(value))
+	if !internal || len(key) < 8 {
+		return
+	}
+	ikey := util.IKey(key)
+	if ikey.KeyType() == util.IKeyTypeDelete {
+		p.NumDeletions++
+	}
+	seq := ikey.SeqNum()
+	if p.NumEntries == 1 || seq < p.SmallestSeq {
+		p.SmallestSeq = seq
+	}
+	if seq > p.LargestSeq {
+		p.LargestSeq = seq
+	}
+}
+
+// encode writes the properties into w. Entries are added in sorted order of their names
+func (p *Properties) encode(w *BlockWriter) {
+	var buf [binary.MaxVarintLen64]byte
+	num := func(name string, v uint64) {
+		n := binary.PutUvarint(buf[:], v)
+		w.append([]byte(name), buf[:n])
+	}
+	w.append([]byte(propComparator), []byte(p.ComparatorName))
+	w.append([]byte(propCompression), []byte(p.Compression))
+	num(propCreationTime, uint64(p.CreationTime))
+	num(propDataSize, p.DataSize)
+	num(propFilterSize, p.FilterSize)
+	num(propIndexSize, p.IndexSize)
+	num(propLargestSeq, p.LargestSeq)
+	num(propNumDataBlocks, p.NumDataBlocks)
+	num(propNumDeletions, p.NumDeletions)
+	num(propNumEntries, p.NumEntries)
+	num(propNumRangeDels, p.NumRangeDeletions)
+	num(propRawKeySize, p.RawKeySize)
+	num(propRawValueSize, p.RawValueSize)
+	num(propSmallestSeq, p.SmallestSeq)
+}
+
+func (p *Properties) decode(block []byte) error {
+	it := newBlockIter(block, &util.StringComparator{})
+	for it.Next() == nil {
+		name, value := string(it.Key()), it.Value()
+		var dst *uint64
+		switch name {
+		case propComparator:
+			p.ComparatorName = string(value)
+			continue
+		case propCompression:
+			p.Compression = string(value)
+			continue
+		case propCreationTime:
+			v, n := binary.Uvarint(value)
+			if n <= 0 {
+				return errors.New("corruption: invalid property " + name)
+			}
+			p.CreationTime = int64(v)
+			continue
+		case propDataSize:
+			dst = &p.DataSize
+		case propFilterSize:
+			dst = &p.FilterSize
+		case propIndexSize:
+			dst = &p.IndexSize
+		case propLargestSeq:
+			dst = &p.LargestSeq
+		case propNumDataBlocks:
+			dst = &p.NumDataBlocks
+		case propNumDeletions:
+			dst = &p.NumDeletions
+		case propNumEntries:
+			dst = &p.NumEntries
+		case propNumRangeDels:
+			dst = &p.NumRangeDeletions
+		case propRawKeySize:
+			dst = &p.RawKeySize
+		case propRawValueSize:
+			dst = &p.RawValueSize
+		case propSmallestSeq:
+			dst = &p.SmallestSeq
+		default:
+			// written by a newer version
+			continue
+		}
+		v, n := binary.Uvarint(value)
+		if n <= 0 {
+			return errors.New("corruption: invalid property " + name)
+		}
+		*dst = v
+	}
+	return nil
+}
@@ -5,13 +5,15 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"github.com/golang/snappy"
 	"leveldb_go/crc"
 	"leveldb_go/util"
 	"sort"
 	"unsafe"
 )
 
+// BlockEndErr is returned by iterators once they move past the last entry
+var BlockEndErr = errors.New("end of block")
+
 type BlockIter struct {
 	data []byte
 	//nRestarts     int
@@ -62,7 +64,7 @@ func (b *BlockIter) decodeEntry(offset int) (int, int, int, int) {
 
 func (b *BlockIter) Next() error {
 	if b.offset == b.restartOffset {
-		return errors.New("end of block")
+		return BlockEndErr
 	}
 
 	shared, nonshared, valLen, tmp := b.decodeEntry(b.offset)
@@ -87,6 +89,10 @@ func (b *BlockIter) Next() error {
 }
 
 func (b *BlockIter) Seek(key []byte) bool {
+	if b.restartOffset == 0 {
+		// empty block, e.g. the index of a table holding only range tombstones
+		return false
+	}
 	i := sort.Search(len(b.restarts), func(i int) bool {
 		restart := int(b.restarts[len(b.restarts)-i-1]) // need to invert
 		_, nonshared, _, offset := b.decodeEntry(restart)
@@ -127,14 +133,23 @@ type Reader struct {
 	indexBlock []byte
 
 	cmp util.Comparator
+
+	// the whole table if it is memory mapped
+	data   []byte
+	budget *MmapBudget
 }
 
 func NewReader(reader RandomAccessReader, size int, cmp util.Comparator) (*Reader, error) {
+	return newReader(reader, size, cmp, nil)
+}
+
+func newReader(reader RandomAccessReader, size int, cmp util.Comparator, data []byte) (*Reader, error) {
 	r := &Reader{
 		reader:         reader,
 		verifyChecksum: true,
 		buf:            make([]byte, 50),
 		cmp:            cmp,
+		data:           data,
 	}
 	if size < tableFooterLen+8 {
 		return nil, fmt.Errorf("corruption: table is too small")
@@ -162,6 +177,53 @@ func NewReader(reader RandomAccessReader, size int, cmp util.Comparator) (*Reade
 	return r, nil
 }
 
+// Properties returns the properties recorded when the table was written
+func (r *Reader) Properties() (*Properties, error) {
+	block, err := r.readMetaBlock(propertiesBlockName)
+	if err != nil {
+		return nil, err
+	}
+	if block == nil {
+		return nil, PropertiesNotFoundErr
+	}
+	props := &Properties{}
+	err = props.decode(block)
+	if err != nil {
+		return nil, err
+	}
+	return props, nil
+}
+
+// RangeDelIterator returns an iterator over the range tombstones of the table, in the
+// form given to Writer.AddRangeDel. It is empty if the table has none
+func (r *Reader) RangeDelIterator() (*BlockIter, error) {
+	block, err := r.readMetaBlock(rangeDelBlockName)
+	if err != nil {
+		return nil, err
+	}
+	if block == nil {
+		return &BlockIter{}, nil
+	}
+	return newBlockIter(block, r.cmp), nil
+}
+
+// readMetaBlock returns the meta block called name, nil if the metaindex has no such entry
+func (r *Reader) readMetaBlock(name string) ([]byte, error) {
+	metaIndex, err := r.readBlock(r.metaBH)
+	if err != nil {
+		return nil, err
+	}
+	it := newBlockIter(metaIndex, &util.StringComparator{})
+	if !it.Seek([]byte(name)) || string(it.Key()) != name {
+		return nil, nil
+	}
+	bh, n := decodeBlockHandle(it.Value())
+	if n == 0 {
+		return nil, errors.New("corruption: invalid " + name + " block handle")
+	}
+	return r.readBlock(bh)
+}
+
 func (r *Reader) readFooter(offset int64) (BlockHandle, BlockHandle, error) {
 	_, err := r.reader.ReadAt(r.buf[:40], offset)
 	if err != nil {
@@ -189,11 +251,21 @@ func decodeBlockHandle(buf []byte) (BlockHandle, int) {
 }
 
 func (r *Reader) readBlock(bh BlockHandle) ([]byte, error) {
-	// can optimize by using buffer pool
-	b := make([]byte, bh.size+blockTrailerLen)
-	_, err := r.reader.ReadAt(b, int64(bh.offset))
-	if err != nil {
-		return nil, err
+	var b []byte
+	if r.data != nil {
+		// mapped blocks are not copied
+		end := bh.offset + bh.size + blockTrailerLen
+		if end > uint64(len(r.data)) || end < bh.offset {
+			return nil, fmt.Errorf("corruption: block handle out of range")
+		}
+		b = r.data[bh.offset:end]
+	} else {
+		// can optimize by using buffer pool
+		b = make([]byte, bh.size+blockTrailerLen)
+		_, err := r.reader.ReadAt(b, int64(bh.offset))
+		if err != nil {
+			return nil, err
+		}
 	}
 	if r.verifyChecksum {
 		checksum := crc.New(b[:bh.size+1]).Value()
@@ -203,19 +275,11 @@ func (r *Reader) readBlock(bh BlockHandle) ([]byte, error) {
 		}
 	}
 
-	data := b[:bh.size]
-	switch b[bh.size] {
-	case kNoCompression:
-	case kSnappyCompression:
-		data, err = snappy.Decode(nil, b[:bh.size])
-		if err != nil {
-			return nil, err
-		}
-	default:
+	c, ok := GetCompressor(b[bh.size])
+	if !ok {
 		return nil, fmt.Errorf("invalid compression type %d", b[bh.size])
 	}
-
-	return data, nil
+	return c.Decompress(b[:bh.size])
 }
 
 func (r *Reader) Iterator() *TableIter {
@@ -288,7 +352,12 @@ func (i *TableIter) Seek(key []byte) bool {
 		return false
 	}
 	i.dataIter = newBlockIter(block, i.cmp)
-	return i.dataIter.Seek(key)
+	if i.dataIter.Seek(key) {
+		return true
+	}
+	// index keys are separators, key may be past the last entry of the block but
+	// before the first entry of the next one
+	return i.Next() == nil
 }
 
 func (i *TableIter) GetIKey(ikey util.IKey) ([]byte, bool) {
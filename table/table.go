@@ -7,6 +7,9 @@ const (
 	blockTrailerLen   = 5
 	tableFooterLen    = 40
 	TableMaxBlockSize = 4096
+
+	// metaindex key of the block holding the range tombstones
+	rangeDelBlockName = "leveldb.range_del"
 )
 
 const (
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"leveldb_go/util"
+	"os"
+	"strings"
 	"testing"
 )
 
@@ -113,9 +115,9 @@ func TestReadWriteTableSimple(t *testing.T) {
 		{"hello2", "x2"},
 		{"hellp", "x3"},
 	}
-	buffer := make([]byte, 500)
+	buffer := make([]byte, 1000)
 	writer := newByteWriter(&buffer)
-	w := NewWriter(writer, 50)
+	w := NewWriter(writer, 50, cmp)
 	for _, kv := range testKVs {
 		err := w.Add([]byte(kv.key), []byte(kv.value))
 		if err != nil {
@@ -148,9 +150,9 @@ func TestReadWriteTableIKeySimple(t *testing.T) {
 		{"hello2", "x2"},
 		{"hello3", "x3"},
 	}
-	buffer := make([]byte, 500)
+	buffer := make([]byte, 1000)
 	writer := newByteWriter(&buffer)
-	w := NewWriter(writer, 50)
+	w := NewWriter(writer, 50, util.IKeyStringCmp)
 	for _, kv := range testKVs {
 		key := util.CreateIKey([]byte(kv.key), util.IKeyTypeSet, 0)
 		err := w.Add(key, []byte(kv.value))
@@ -201,7 +203,7 @@ func TestReadWriteTableLarge(t *testing.T) {
 	}
 	buffer := make([]byte, 20000)
 	writer := newByteWriter(&buffer)
-	w := NewWriter(writer, 50)
+	w := NewWriter(writer, 50, cmp)
 	for _, kv := range testKVs {
 		err := w.Add([]byte(kv.key), []byte(kv.value))
 		if err != nil {
@@ -237,9 +239,9 @@ func TestTableSeekMultiple(t *testing.T) {
 		})
 	}
 
-	buffer := make([]byte, 500)
+	buffer := make([]byte, 1000)
 	writer := newByteWriter(&buffer)
-	w := NewWriter(writer, 50)
+	w := NewWriter(writer, 50, cmp)
 	for _, kv := range testKVs {
 		err := w.Add([]byte(kv.key), []byte(kv.value))
 		if err != nil {
@@ -265,3 +267,260 @@ func TestTableSeekMultiple(t *testing.T) {
 		assert.Equal(t, testKVs[i].value, string(iter.Value()))
 	}
 }
+
+func TestTableProperties(t *testing.T) {
+	buffer := make([]byte, 20000)
+	writer := newByteWriter(&buffer)
+	w := NewWriter(writer, 200, util.IKeyStringCmp)
+	for i := 0; i < 100; i++ {
+		keyType := util.IKeyTypeSet
+		if i%10 == 0 {
+			keyType = util.IKeyTypeDelete
+		}
+		key := util.CreateIKey([]byte(fmt.Sprintf("key%03d", i)), keyType, uint64(i+5))
+		err := w.Add(key, []byte("value"))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, w.Close())
+	writer.Close()
+
+	r, err := NewReader(newByteReader(buffer), len(buffer), util.IKeyStringCmp)
+	assert.Nil(t, err)
+	props, err := r.Properties()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(100), props.NumEntries)
+	assert.Equal(t, uint64(10), props.NumDeletions)
+	assert.Equal(t, uint64(100*(6+8)), props.RawKeySize)
+	assert.Equal(t, uint64(100*5), props.RawValueSize)
+	assert.Equal(t, uint64(5), props.SmallestSeq)
+	assert.Equal(t, uint64(104), props.LargestSeq)
+	assert.True(t, props.NumDataBlocks > 1)
+	assert.True(t, props.DataSize > 0 && props.IndexSize > 0)
+	assert.Equal(t, "snappy", props.Compression)
+	assert.Equal(t, "leveldb.BytewiseComparator", props.ComparatorName)
+	assert.True(t, props.CreationTime > 0)
+}
+
+func TestTableRangeDels(t *testing.T) {
+	buffer := make([]byte, 20000)
+	writer := newByteWriter(&buffer)
+	w := NewWriter(writer, 200, util.IKeyStringCmp)
+	for i := 0; i < 10; i++ {
+		key := util.CreateIKey([]byte(fmt.Sprint("key", i)), util.IKeyTypeSet, uint64(i+1))
+		assert.Nil(t, w.Add(key, []byte("value")))
+	}
+	w.AddRangeDel(util.CreateIKey([]byte("a"), util.IKeyTypeRangeDelete, 20), []byte("b"))
+	w.AddRangeDel(util.CreateIKey([]byte("key3"), util.IKeyTypeRangeDelete, 21), []byte("key5"))
+	assert.Nil(t, w.Close())
+	writer.Close()
+
+	r, err := NewReader(newByteReader(buffer), len(buffer), util.IKeyStringCmp)
+	assert.Nil(t, err)
+	it, err := r.RangeDelIterator()
+	assert.Nil(t, err)
+	assert.Nil(t, it.Next())
+	assert.Equal(t, "a", string(util.IKey(it.Key()).Key()))
+	assert.Equal(t, "b", string(it.Value()))
+	assert.Nil(t, it.Next())
+	assert.Equal(t, uint64(21), util.IKey(it.Key()).SeqNum())
+	assert.Equal(t, "key5", string(it.Value()))
+	assert.Equal(t, BlockEndErr, it.Next())
+
+	// tombstones are not point entries
+	n := 0
+	for iter := r.Iterator(); iter.Next() == nil; n++ {
+	}
+	assert.Equal(t, 10, n)
+	props, err := r.Properties()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(10), props.NumEntries)
+	assert.Equal(t, uint64(2), props.NumRangeDeletions)
+
+	// a table without tombstones has an empty iterator
+	buffer = make([]byte, 20000)
+	writer = newByteWriter(&buffer)
+	w = NewWriter(writer, 200, util.IKeyStringCmp)
+	assert.Nil(t, w.Add(util.CreateIKey([]byte("key"), util.IKeyTypeSet, 1), []byte("value")))
+	assert.Nil(t, w.Close())
+	writer.Close()
+	r, err = NewReader(newByteReader(buffer), len(buffer), util.IKeyStringCmp)
+	assert.Nil(t, err)
+	it, err = r.RangeDelIterator()
+	assert.Nil(t, err)
+	assert.Equal(t, BlockEndErr, it.Next())
+}
+
+type xorCompressor struct{}
+
+func (xorCompressor) Type() byte {
+	return 0x70
+}
+
+func (xorCompressor) Name() string {
+	return "xor"
+}
+
+func (xorCompressor) Compress(dst, src []byte) ([]byte, error) {
+	// not a real compression, just shorter so the writer keeps it
+	dst = dst[:0]
+	for i := 0; i < len(src); i += 2 {
+		dst = append(dst, src[i]^0xff)
+	}
+	return dst, nil
+}
+
+func (xorCompressor) Decompress(src []byte) ([]byte, error) {
+	return nil, fmt.Errorf("lossy")
+}
+
+func TestTableCompression(t *testing.T) {
+	var testKVs []testKV
+	for i := 0; i < 300; i++ {
+		testKVs = append(testKVs, testKV{fmt.Sprintf("key%04d", i), fmt.Sprint("value value value", i)})
+	}
+
+	for _, c := range []Compressor{NoCompression, SnappyCompression, ZlibCompression, FlateCompression} {
+		buffer := make([]byte, 20000)
+		writer := newByteWriter(&buffer)
+		w := NewWriter(writer, 1000, cmp)
+		w.SetCompressor(c)
+		for _, kv := range testKVs {
+			assert.Nil(t, w.Add([]byte(kv.key), []byte(kv.value)))
+		}
+		assert.Nil(t, w.Close())
+		writer.Close()
+
+		r, err := NewReader(newByteReader(buffer), len(buffer), cmp)
+		assert.Nil(t, err)
+		iter := r.Iterator()
+		i := 0
+		for i = 0; iter.Next() == nil; i++ {
+			assert.Equal(t, testKVs[i].key, string(iter.Key()))
+			assert.Equal(t, testKVs[i].value, string(iter.Value()))
+		}
+		assert.Equal(t, len(testKVs), i, c.Name())
+		props, err := r.Properties()
+		assert.Nil(t, err)
+		assert.Equal(t, c.Name(), props.Compression)
+	}
+}
+
+func TestRegisterCompressor(t *testing.T) {
+	assert.NotNil(t, RegisterCompressor(ZlibCompression))
+
+	buffer := make([]byte, 20000)
+	writer := newByteWriter(&buffer)
+	w := NewWriter(writer, 1000, cmp)
+	w.SetCompressor(xorCompressor{})
+	assert.Nil(t, w.Add([]byte("key"), make([]byte, 100)))
+	assert.Nil(t, w.Close())
+	writer.Close()
+
+	// blocks of an unknown type can't be read
+	_, err := NewReader(newByteReader(buffer), len(buffer), cmp)
+	assert.NotNil(t, err)
+
+	assert.Nil(t, RegisterCompressor(xorCompressor{}))
+	c, ok := GetCompressor(0x70)
+	assert.True(t, ok)
+	assert.Equal(t, "xor", c.Name())
+}
+
+func TestTableSeparatorIndexKeys(t *testing.T) {
+	prefix := strings.Repeat("long common prefix ", 5)
+	var testKVs []testKV
+	for i := 0; i < 20; i++ {
+		testKVs = append(testKVs, testKV{
+			fmt.Sprintf("%c%s%02d", 'A'+3*i, prefix, i),
+			fmt.Sprint("value", i),
+		})
+	}
+
+	buffer := make([]byte, 20000)
+	writer := newByteWriter(&buffer)
+	w := NewWriter(writer, 100, cmp)
+	for _, kv := range testKVs {
+		assert.Nil(t, w.Add([]byte(kv.key), []byte(kv.value)))
+	}
+	assert.Nil(t, w.Close())
+	writer.Close()
+
+	r, err := NewReader(newByteReader(buffer), len(buffer), cmp)
+	assert.Nil(t, err)
+	index := newBlockIter(r.indexBlock, cmp)
+	n := 0
+	for ; index.Next() == nil; n++ {
+		assert.Equal(t, 1, len(index.Key()))
+	}
+	assert.Equal(t, len(testKVs), n)
+
+	// keys between the last key of a block and its index key land on the next block
+	iter := r.Iterator()
+	for i := 0; i < len(testKVs)-1; i++ {
+		assert.True(t, iter.Seek([]byte(testKVs[i].key+"~")))
+		assert.Equal(t, testKVs[i+1].key, string(iter.Key()))
+	}
+	assert.False(t, iter.Seek([]byte(testKVs[len(testKVs)-1].key+"~")))
+}
+
+func TestSeparatorSuccessor(t *testing.T) {
+	assert.Equal(t, "abd", string(cmp.Separator([]byte("abcdef"), []byte("abzz"))))
+	assert.Equal(t, "abc", string(cmp.Separator([]byte("abc"), []byte("abcd"))))
+	assert.Equal(t, "abcx", string(cmp.Separator([]byte("abcx"), []byte("abdy"))))
+	assert.Equal(t, "b", string(cmp.Successor([]byte("abc"))))
+	assert.Equal(t, "\xff\xffb", string(cmp.Successor([]byte("\xff\xffabc"))))
+
+	a := util.CreateIKey([]byte("abcdef"), util.IKeyTypeSet, 5)
+	b := util.CreateIKey([]byte("abzz"), util.IKeyTypeSet, 7)
+	sep := util.IKey(util.IKeyStringCmp.Separator(a, b))
+	assert.Equal(t, "abd", string(sep.Key()))
+	assert.True(t, util.IKeyStringCmp.Compare(a, sep) < 0)
+	assert.True(t, util.IKeyStringCmp.Compare(sep, b) < 0)
+	succ := util.IKey(util.IKeyStringCmp.Successor(a))
+	assert.Equal(t, "b", string(succ.Key()))
+}
+
+func TestMmapReader(t *testing.T) {
+	var testKVs []testKV
+	for i := 0; i < 200; i++ {
+		testKVs = append(testKVs, testKV{fmt.Sprintf("key%04d", i), fmt.Sprint("value", i)})
+	}
+	f, err := os.CreateTemp("", "mmap*.ldb")
+	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+	w := NewWriter(f, 200, cmp)
+	w.SetCompressor(NoCompression)
+	for _, kv := range testKVs {
+		assert.Nil(t, w.Add([]byte(kv.key), []byte(kv.value)))
+	}
+	assert.Nil(t, w.Close())
+	size := int(w.Len())
+
+	budget := NewMmapBudget(int64(size))
+	r, err := NewMmapReader(f, size, cmp, budget)
+	assert.Nil(t, err)
+	assert.True(t, r.Mapped())
+	assert.Equal(t, int64(size), budget.Used())
+
+	// the budget is used up, so the second reader falls back to ReadAt
+	r2, err := NewMmapReader(f, size, cmp, budget)
+	assert.Nil(t, err)
+	assert.False(t, r2.Mapped())
+
+	for _, reader := range []*Reader{r, r2} {
+		iter := reader.Iterator()
+		i := 0
+		for i = 0; iter.Next() == nil; i++ {
+			assert.Equal(t, testKVs[i].key, string(iter.Key()))
+			assert.Equal(t, testKVs[i].value, string(iter.Value()))
+		}
+		assert.Equal(t, len(testKVs), i)
+		assert.True(t, iter.Seek([]byte("key0150")))
+		assert.Equal(t, "value150", string(iter.Value()))
+	}
+
+	assert.Nil(t, r.Close())
+	assert.Nil(t, r2.Close())
+	assert.Equal(t, int64(0), budget.Used())
+}
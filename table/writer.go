@@ -4,9 +4,10 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/binary"
-	"github.com/golang/snappy"
 	"io"
 	"leveldb_go/crc"
+	"leveldb_go/util"
+	"time"
 )
 
 type BlockWriter struct {
@@ -22,14 +23,21 @@ type BlockWriter struct {
 type Writer struct {
 	writer *CountingWriter
 	//closer      io.Closer
-	blockWriter *BlockWriter
-	indexWriter *BlockWriter
+	blockWriter    *BlockWriter
+	indexWriter    *BlockWriter
+	rangeDelWriter *BlockWriter
 
 	pendingBH  BlockHandle
 	pendingKey []byte
 
 	maxBlockSize int
 
+	cmp      util.Comparator
+	internal bool // keys are internal keys
+	props    Properties
+
+	compressor Compressor
+
 	compressBuf []byte
 	buf         []byte
 }
@@ -63,7 +71,8 @@ func (w *BlockWriter) append(key, value []byte) {
 	w.writer.Write(key[shared:])
 	w.writer.Write(value)
 
-	w.lastKey = key
+	// key may be a buffer the caller reuses
+	w.lastKey = append(w.lastKey[:0], key...)
 	w.counter++
 
 }
@@ -97,19 +106,35 @@ func (w *BlockWriter) Empty() bool {
 	return w.writer.Len() == 0
 }
 
-func NewWriter(writer io.WriteCloser, maxBlockSize int) *Writer {
+// NewWriter returns a writer for a table whose keys are ordered by cmp
+func NewWriter(writer io.WriteCloser, maxBlockSize int, cmp util.Comparator) *Writer {
+	_, internal := cmp.(util.IKeyCmp)
 	return &Writer{
 		writer: newCountingWriter(*bufio.NewWriter(writer)),
 		//closer:       writer,
-		blockWriter:  newBlockWriter(16),
-		indexWriter:  newBlockWriter(1),
-		maxBlockSize: maxBlockSize,
-		buf:          make([]byte, 40),
+		blockWriter:    newBlockWriter(16),
+		indexWriter:    newBlockWriter(1),
+		rangeDelWriter: newBlockWriter(16),
+		maxBlockSize:   maxBlockSize,
+		cmp:            cmp,
+		internal:       internal,
+		compressor:     SnappyCompression,
+		buf:            make([]byte, 40),
 	}
 }
 
+// SetCompressor selects the compression of the blocks written after the call,
+// SnappyCompression by default
+func (w *Writer) SetCompressor(c Compressor) {
+	w.compressor = c
+}
+
 func (w *Writer) Add(key, value []byte) error {
+	// the index entry of the previous block is only written once the first key of the
+	// next block is known, so that a short separator can be used
+	w.writePendingBH(key)
 	w.blockWriter.append(key, value)
+	w.props.add(key, value, w.internal)
 
 	if w.blockWriter.estimatedSize() >= w.maxBlockSize {
 		err := w.finishDataBlock()
@@ -121,40 +146,65 @@ func (w *Writer) Add(key, value []byte) error {
 	return nil
 }
 
+// AddRangeDel adds a range tombstone, key is the internal key of its start and value its
+// end. Tombstones go into their own block and must be added in key order
+func (w *Writer) AddRangeDel(key, value []byte) {
+	w.rangeDelWriter.append(key, value)
+	w.props.NumRangeDeletions++
+}
+
 func (w *Writer) finishDataBlock() error {
 	if w.blockWriter.Empty() {
 		return nil
 	}
 	data := w.blockWriter.finish()
-	w.writePendingBH()
 	bh, err := w.writeBlock(data)
 	if err != nil {
 		return err
 	}
 
+	w.props.NumDataBlocks++
+	w.props.DataSize = w.writer.Offset()
 	w.pendingBH = bh
 	w.pendingKey = append(w.pendingKey[:0], w.blockWriter.LastKey()...)
 	w.blockWriter.reset()
 	return nil
 }
 
-func (w *Writer) writePendingBH() {
-	if w.pendingBH.size > 0 {
-		n := encodeBlockHandle(w.buf, w.pendingBH)
-		w.indexWriter.append(w.pendingKey, w.buf[:n])
+// writePendingBH adds the index entry of the last finished block. Its key is between the
+// last key of that block and nextKey, or after the last key if there is no next block
+func (w *Writer) writePendingBH(nextKey []byte) {
+	if w.pendingBH.size == 0 {
+		return
 	}
+	var key []byte
+	if nextKey != nil {
+		key = w.cmp.Separator(w.pendingKey, nextKey)
+	} else {
+		key = w.cmp.Successor(w.pendingKey)
+	}
+	n := encodeBlockHandle(w.buf, w.pendingBH)
+	w.indexWriter.append(key, w.buf[:n])
+	w.pendingBH = BlockHandle{}
 }
 
 func (w *Writer) writeBlock(block []byte) (BlockHandle, error) {
 	offset := w.writer.Offset()
 	data := block
-	compressionType := kNoCompression
-	w.compressBuf = snappy.Encode(w.compressBuf, block)
-	if len(w.compressBuf) < len(block)-len(block)/8 {
-		data = w.compressBuf
-		compressionType = 1
+	compressionType := byte(kNoCompression)
+	if w.compressor.Type() != kNoCompression {
+		compressed, err := w.compressor.Compress(w.compressBuf, block)
+		if err != nil {
+			return BlockHandle{}, err
+		}
+		w.compressBuf = compressed
+		// only worth it if it saves at least 1/8th of the block
+		if len(compressed) < len(block)-len(block)/8 {
+			data = compressed
+			compressionType = w.compressor.Type()
+		}
 	}
-	w.buf[0] = byte(compressionType)
+	w.buf[0] = compressionType
 
 	checksum := crc.New(data).Update(w.buf[:1]).Value()
 	binary.LittleEndian.PutUint32(w.buf[1:], checksum)
@@ -185,15 +235,41 @@ func (w *Writer) Close() error {
 	if err != nil {
 		return err
 	}
-	// reuse blockWriter for metaIndex
-	metaIndex := w.blockWriter.finish()
-	metaIndexHandle, err := w.writeBlock(metaIndex)
+	w.writePendingBH(nil)
+	index := w.indexWriter.finish()
+
+	// reuse blockWriter for the properties block and the metaindex
+	w.props.IndexSize = uint64(len(index))
+	w.props.Compression = w.compressor.Name()
+	w.props.ComparatorName = w.cmp.Name()
+	w.props.CreationTime = time.Now().Unix()
+	w.props.encode(w.blockWriter)
+	propsHandle, err := w.writeBlock(w.blockWriter.finish())
+	if err != nil {
+		return err
+	}
+	w.blockWriter.reset()
+
+	var rangeDelHandle BlockHandle
+	if !w.rangeDelWriter.Empty() {
+		rangeDelHandle, err = w.writeBlock(w.rangeDelWriter.finish())
+		if err != nil {
+			return err
+		}
+	}
+
+	// metaindex entries are sorted by name
+	n := encodeBlockHandle(w.buf, propsHandle)
+	w.blockWriter.append([]byte(propertiesBlockName), w.buf[:n])
+	if rangeDelHandle.size > 0 {
+		n = encodeBlockHandle(w.buf, rangeDelHandle)
+		w.blockWriter.append([]byte(rangeDelBlockName), w.buf[:n])
+	}
+	metaIndexHandle, err := w.writeBlock(w.blockWriter.finish())
 	if err != nil {
 		return err
 	}
 
-	w.writePendingBH()
-	index := w.indexWriter.finish()
 	indexHandle, err := w.writeBlock(index)
 	if err != nil {
 		return err
@@ -9,6 +9,13 @@ type IKeyType byte
 const (
 	IKeyTypeDelete IKeyType = 0
 	IKeyTypeSet    IKeyType = 1
+	// IKeyTypeMerge holds an operand for the merge operator of the database
+	IKeyTypeMerge IKeyType = 2
+	// IKeyTypeSetWithTTL is a Set whose value starts with its expiry
+	IKeyTypeSetWithTTL IKeyType = 3
+	// IKeyTypeRangeDelete deletes the user keys from the key of the entry up to the key in
+	// its value, excluding the end
+	IKeyTypeRangeDelete IKeyType = 0xF
 )
 
 type IKey []byte
@@ -36,7 +43,7 @@ func (k IKey) KeyType() IKeyType {
 	return IKeyType(k[len(k)-8])
 }
 
-func (k IKey) seqNum() uint64 {
+func (k IKey) SeqNum() uint64 {
 	i := len(k) - 7
 	n := uint64(k[i])
 	n |= uint64(k[i+1]) << 8
@@ -62,10 +69,10 @@ func (i IKeyCmp) Compare(key1, key2 []byte) int {
 		return r
 	}
 
-	if ak.seqNum() < bk.seqNum() {
+	if ak.SeqNum() < bk.SeqNum() {
 		return 1
 	}
-	if ak.seqNum() > bk.seqNum() {
+	if ak.SeqNum() > bk.SeqNum() {
 		return -1
 	}
 	return 0
@@ -77,10 +84,44 @@ func CreateIKeyCmp(cmp Comparator) Comparator {
 	}
 }
 
+// MaxSeqNum is the largest sequence number that fits in an internal key
+const MaxSeqNum = 1<<56 - 1
+
+// Separator shortens the user key of a. The result gets the largest sequence number, so
+// it sorts before every real entry with the same user key
+func (i IKeyCmp) Separator(a, b []byte) []byte {
+	ua, ub := IKey(a).Key(), IKey(b).Key()
+	sep := i.cmp.Separator(ua, ub)
+	if len(sep) < len(ua) && i.cmp.Compare(ua, sep) < 0 {
+		return CreateIKey(sep, IKeyTypeSet, MaxSeqNum)
+	}
+	return a
+}
+
+func (i IKeyCmp) Successor(a []byte) []byte {
+	ua := IKey(a).Key()
+	succ := i.cmp.Successor(ua)
+	if len(succ) < len(ua) && i.cmp.Compare(ua, succ) < 0 {
+		return CreateIKey(succ, IKeyTypeSet, MaxSeqNum)
+	}
+	return a
+}
+
+// Name returns the name of the user key comparator, internal keys are only an encoding
+func (i IKeyCmp) Name() string {
+	return i.cmp.Name()
+}
+
 var IKeyStringCmp = CreateIKeyCmp(&StringComparator{})
 
 type Comparator interface {
 	Compare(key1, key2 []byte) int
+	// Name identifies the ordering, it is recorded in tables
+	Name() string
+	// Separator returns a short key k with a <= k < b, it must not modify a or b
+	Separator(a, b []byte) []byte
+	// Successor returns a short key k with a <= k, it must not modify a
+	Successor(a []byte) []byte
 }
 
 type StringComparator struct{}
@@ -88,3 +129,40 @@ type StringComparator struct{}
 func (s *StringComparator) Compare(key1, key2 []byte) int {
 	return strings.Compare(string(key1), string(key2))
 }
+
+func (s *StringComparator) Name() string {
+	return "leveldb.BytewiseComparator"
+}
+
+func (s *StringComparator) Separator(a, b []byte) []byte {
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+	i := 0
+	for i < n && a[i] == b[i] {
+		i++
+	}
+	if i == n {
+		// one is a prefix of the other
+		return a
+	}
+	if a[i] < 0xff && a[i]+1 < b[i] {
+		sep := append([]byte{}, a[:i+1]...)
+		sep[i]++
+		return sep
+	}
+	return a
+}
+
+func (s *StringComparator) Successor(a []byte) []byte {
+	for i := range a {
+		if a[i] != 0xff {
+			succ := append([]byte{}, a[:i+1]...)
+			succ[i]++
+			return succ
+		}
+	}
+	// a is a run of 0xff
+	return a
+}
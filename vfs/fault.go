@@ -0,0 +1,335 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// InjectedErr is returned by operations that fail because of an injected fault
+var InjectedErr = errors.New("injected fault")
+
+// OpKind selects the operations a fault is injected into
+type OpKind int
+
+const (
+	OpWrite OpKind = 1 << iota
+	OpSync
+	OpRename
+)
+
+// FaultFS wraps another FS to simulate crashes and I/O errors.
+// It remembers how much of every file it created has been synced, so that Crash can
+// drop everything that was not synced, and it can be set up to fail operations after
+// a number of them have succeeded.
+// Creations, renames and removals are assumed to be durable as soon as they return.
+type FaultFS struct {
+	fs FS
+
+	mu        sync.Mutex
+	synced    map[string]int64
+	locks     []io.Closer
+	gen       int
+	kinds     OpKind
+	remaining int
+	failing   bool
+	torn      bool
+	err       error
+}
+
+// NewFault returns a FaultFS on top of fs with no faults injected
+func NewFault(fs FS) *FaultFS {
+	return &FaultFS{
+		fs:     fs,
+		synced: make(map[string]int64),
+	}
+}
+
+// InjectFault makes every operation of the given kinds fail once n of them have succeeded.
+// If torn is set, a failing write persists a prefix of its data before returning the error.
+func (f *FaultFS) InjectFault(kinds OpKind, n int, torn bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.kinds = kinds
+	f.remaining = n
+	f.failing = false
+	f.torn = torn
+}
+
+// SetFaultErr makes failing operations return err rather than InjectedErr, for example
+// syscall.ENOSPC to simulate a full disk
+func (f *FaultFS) SetFaultErr(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.err = err
+}
+
+func (f *FaultFS) faultErr() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.err != nil {
+		return f.err
+	}
+	return InjectedErr
+}
+
+// ClearFaults stops injecting faults
+func (f *FaultFS) ClearFaults() {
+	f.InjectFault(0, 0, false)
+}
+
+// Failing reports whether an injected fault has been triggered
+func (f *FaultFS) Failing() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.failing
+}
+
+// Crash simulates a machine crash. Unsynced data of every file is dropped, locks are
+// released, files opened before the crash can no longer be used and faults are cleared.
+func (f *FaultFS) Crash() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.gen++
+	f.kinds = 0
+	f.failing = false
+	for _, l := range f.locks {
+		l.Close()
+	}
+	f.locks = nil
+
+	for name, synced := range f.synced {
+		err := f.truncate(name, synced)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *FaultFS) truncate(name string, size int64) error {
+	stat, err := f.fs.Stat(name)
+	if os.IsNotExist(err) {
+		delete(f.synced, name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if stat.Size() <= size {
+		return nil
+	}
+
+	r, err := f.fs.Open(name)
+	if err != nil {
+		return err
+	}
+	data := make([]byte, size)
+	_, err = r.ReadAt(data, 0)
+	r.Close()
+	if err != nil && err != io.EOF {
+		return err
+	}
+	w, err := f.fs.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	if err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// shouldFail counts an operation of the given kind and reports whether it has to fail
+func (f *FaultFS) shouldFail(kind OpKind) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.kinds&kind == 0 {
+		return false
+	}
+	if f.failing {
+		return true
+	}
+	if f.remaining > 0 {
+		f.remaining--
+		return false
+	}
+	f.failing = true
+	return true
+}
+
+func (f *FaultFS) Create(name string) (File, error) {
+	file, err := f.fs.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	name = filepath.Clean(name)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.synced[name] = 0
+	return &faultFile{File: file, fs: f, name: name, gen: f.gen}, nil
+}
+
+func (f *FaultFS) Open(name string) (File, error) {
+	file, err := f.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return &faultFile{File: file, fs: f, name: filepath.Clean(name), gen: f.gen}, nil
+}
+
+func (f *FaultFS) Rename(oldname, newname string) error {
+	if f.shouldFail(OpRename) {
+		return f.faultErr()
+	}
+	err := f.fs.Rename(oldname, newname)
+	if err != nil {
+		return err
+	}
+	oldname, newname = filepath.Clean(oldname), filepath.Clean(newname)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.synced, newname)
+	if synced, ok := f.synced[oldname]; ok {
+		delete(f.synced, oldname)
+		f.synced[newname] = synced
+	}
+	return nil
+}
+
+func (f *FaultFS) Link(oldname, newname string) error {
+	err := f.fs.Link(oldname, newname)
+	if err != nil {
+		return err
+	}
+	oldname, newname = filepath.Clean(oldname), filepath.Clean(newname)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if synced, ok := f.synced[oldname]; ok {
+		f.synced[newname] = synced
+	}
+	return nil
+}
+
+func (f *FaultFS) Remove(name string) error {
+	err := f.fs.Remove(name)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.synced, filepath.Clean(name))
+	return nil
+}
+
+func (f *FaultFS) List(dirname string) ([]string, error) {
+	return f.fs.List(dirname)
+}
+
+func (f *FaultFS) Lock(name string) (io.Closer, error) {
+	l, err := f.fs.Lock(name)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.locks = append(f.locks, l)
+	return l, nil
+}
+
+func (f *FaultFS) MkdirAll(dirname string, perm os.FileMode) error {
+	return f.fs.MkdirAll(dirname, perm)
+}
+
+func (f *FaultFS) Stat(name string) (os.FileInfo, error) {
+	return f.fs.Stat(name)
+}
+
+func (f *FaultFS) SyncDir(dirname string) error {
+	if f.shouldFail(OpSync) {
+		return f.faultErr()
+	}
+	return f.fs.SyncDir(dirname)
+}
+
+type faultFile struct {
+	File
+	fs   *FaultFS
+	name string
+	gen  int
+}
+
+var crashedErr = errors.New("file was opened before a crash")
+
+func (f *faultFile) stale() bool {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	return f.gen != f.fs.gen
+}
+
+func (f *faultFile) Read(p []byte) (int, error) {
+	if f.stale() {
+		return 0, crashedErr
+	}
+	return f.File.Read(p)
+}
+
+func (f *faultFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.stale() {
+		return 0, crashedErr
+	}
+	return f.File.ReadAt(p, off)
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	if f.stale() {
+		return 0, crashedErr
+	}
+	if f.fs.shouldFail(OpWrite) {
+		f.fs.mu.Lock()
+		torn := f.fs.torn
+		f.fs.mu.Unlock()
+		if torn && len(p) > 1 {
+			n, _ := f.File.Write(p[:len(p)/2])
+			return n, f.fs.faultErr()
+		}
+		return 0, f.fs.faultErr()
+	}
+	return f.File.Write(p)
+}
+
+func (f *faultFile) Sync() error {
+	if f.stale() {
+		return crashedErr
+	}
+	if f.fs.shouldFail(OpSync) {
+		return f.fs.faultErr()
+	}
+	err := f.File.Sync()
+	if err != nil {
+		return err
+	}
+	stat, err := f.File.Stat()
+	if err != nil {
+		return err
+	}
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if _, ok := f.fs.synced[f.name]; ok {
+		f.fs.synced[f.name] = stat.Size()
+	}
+	return nil
+}
+
+func (f *faultFile) Close() error {
+	if f.stale() {
+		return nil
+	}
+	return f.File.Close()
+}
@@ -0,0 +1,96 @@
+package vfs
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"syscall"
+	"testing"
+)
+
+func readAll(t *testing.T, fs FS, name string) string {
+	f, err := fs.Open(name)
+	assert.Nil(t, err)
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	assert.Nil(t, err)
+	return string(data)
+}
+
+func TestFaultFSDropUnsynced(t *testing.T) {
+	fs := NewFault(NewMem())
+
+	f, err := fs.Create("file")
+	assert.Nil(t, err)
+	f.Write([]byte("synced"))
+	assert.Nil(t, f.Sync())
+	f.Write([]byte(" lost"))
+
+	assert.Nil(t, fs.Crash())
+	assert.Equal(t, "synced", readAll(t, fs, "file"))
+
+	// handles from before the crash are dead
+	_, err = f.Write([]byte("more"))
+	assert.NotNil(t, err)
+}
+
+func TestFaultFSFailAfter(t *testing.T) {
+	fs := NewFault(NewMem())
+	fs.InjectFault(OpWrite, 2, false)
+
+	f, err := fs.Create("file")
+	assert.Nil(t, err)
+	_, err = f.Write([]byte("a"))
+	assert.Nil(t, err)
+	_, err = f.Write([]byte("b"))
+	assert.Nil(t, err)
+	_, err = f.Write([]byte("c"))
+	assert.Equal(t, InjectedErr, err)
+	assert.True(t, fs.Failing())
+	// syncs are unaffected, writes keep failing
+	assert.Nil(t, f.Sync())
+	_, err = f.Write([]byte("d"))
+	assert.Equal(t, InjectedErr, err)
+
+	fs.ClearFaults()
+	assert.Equal(t, "ab", readAll(t, fs, "file"))
+}
+
+func TestFaultFSTornWrite(t *testing.T) {
+	fs := NewFault(NewMem())
+	fs.InjectFault(OpWrite, 0, true)
+
+	f, err := fs.Create("file")
+	assert.Nil(t, err)
+	n, err := f.Write([]byte("abcdef"))
+	assert.Equal(t, InjectedErr, err)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, "abc", readAll(t, fs, "file"))
+}
+
+func TestFaultFSRename(t *testing.T) {
+	fs := NewFault(NewMem())
+	f, _ := fs.Create("tmp")
+	f.Write([]byte("data"))
+	f.Sync()
+	f.Close()
+
+	fs.InjectFault(OpRename, 0, false)
+	assert.Equal(t, InjectedErr, fs.Rename("tmp", "final"))
+	fs.ClearFaults()
+	assert.Nil(t, fs.Rename("tmp", "final"))
+
+	assert.Nil(t, fs.Crash())
+	assert.Equal(t, "data", readAll(t, fs, "final"))
+}
+
+func TestFaultFSFaultErr(t *testing.T) {
+	fs := NewFault(NewMem())
+	fs.SetFaultErr(syscall.ENOSPC)
+	fs.InjectFault(OpWrite|OpSync, 0, false)
+
+	f, err := fs.Create("file")
+	assert.Nil(t, err)
+	_, err = f.Write([]byte("a"))
+	assert.Equal(t, syscall.ENOSPC, err)
+	assert.Equal(t, syscall.ENOSPC, f.Sync())
+}
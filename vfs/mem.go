@@ -0,0 +1,364 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemFS is an FS that keeps every file in memory. It is safe for concurrent use
+type MemFS struct {
+	mu    sync.Mutex
+	files map[string]*memNode
+	dirs  map[string]bool
+	locks map[string]bool
+}
+
+// NewMem returns an empty in-memory FS
+func NewMem() *MemFS {
+	return &MemFS{
+		files: make(map[string]*memNode),
+		dirs:  map[string]bool{".": true, "/": true},
+		locks: make(map[string]bool),
+	}
+}
+
+type memNode struct {
+	mu      sync.Mutex
+	name    string
+	data    []byte
+	modTime time.Time
+}
+
+func clean(name string) string {
+	return filepath.Clean(name)
+}
+
+func pathErr(op, name string, err error) error {
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+func (m *MemFS) parentExists(name string) bool {
+	return m.dirs[filepath.Dir(name)]
+}
+
+func (m *MemFS) Create(name string) (File, error) {
+	name = clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.parentExists(name) {
+		return nil, pathErr("create", name, os.ErrNotExist)
+	}
+	if m.dirs[name] {
+		return nil, pathErr("create", name, errors.New("is a directory"))
+	}
+	n, ok := m.files[name]
+	if ok {
+		n.mu.Lock()
+		n.data = n.data[:0]
+		n.modTime = time.Now()
+		n.mu.Unlock()
+	} else {
+		n = &memNode{name: filepath.Base(name), modTime: time.Now()}
+		m.files[name] = n
+	}
+	return &memFile{n: n, write: true}, nil
+}
+
+func (m *MemFS) Open(name string) (File, error) {
+	name = clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, ok := m.files[name]
+	if !ok {
+		return nil, pathErr("open", name, os.ErrNotExist)
+	}
+	return &memFile{n: n}, nil
+}
+
+func (m *MemFS) Rename(oldname, newname string) error {
+	oldname, newname = clean(oldname), clean(newname)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, ok := m.files[oldname]
+	if !ok {
+		return pathErr("rename", oldname, os.ErrNotExist)
+	}
+	if !m.parentExists(newname) {
+		return pathErr("rename", newname, os.ErrNotExist)
+	}
+	delete(m.files, oldname)
+	n.mu.Lock()
+	n.name = filepath.Base(newname)
+	n.mu.Unlock()
+	m.files[newname] = n
+	return nil
+}
+
+func (m *MemFS) Link(oldname, newname string) error {
+	oldname, newname = clean(oldname), clean(newname)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, ok := m.files[oldname]
+	if !ok {
+		return pathErr("link", oldname, os.ErrNotExist)
+	}
+	if !m.parentExists(newname) {
+		return pathErr("link", newname, os.ErrNotExist)
+	}
+	if _, ok := m.files[newname]; ok || m.dirs[newname] {
+		return pathErr("link", newname, os.ErrExist)
+	}
+	m.files[newname] = n
+	return nil
+}
+
+func (m *MemFS) Remove(name string) error {
+	name = clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.files[name]; ok {
+		delete(m.files, name)
+		return nil
+	}
+	if !m.dirs[name] {
+		return pathErr("remove", name, os.ErrNotExist)
+	}
+	if len(m.listLocked(name)) > 0 {
+		return pathErr("remove", name, errors.New("directory not empty"))
+	}
+	delete(m.dirs, name)
+	return nil
+}
+
+func (m *MemFS) List(dirname string) ([]string, error) {
+	dirname = clean(dirname)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.dirs[dirname] {
+		return nil, pathErr("open", dirname, os.ErrNotExist)
+	}
+	return m.listLocked(dirname), nil
+}
+
+func (m *MemFS) listLocked(dirname string) []string {
+	var names []string
+	for name := range m.files {
+		if filepath.Dir(name) == dirname {
+			names = append(names, filepath.Base(name))
+		}
+	}
+	for name := range m.dirs {
+		if name != dirname && filepath.Dir(name) == dirname {
+			names = append(names, filepath.Base(name))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (m *MemFS) Lock(name string) (io.Closer, error) {
+	name = clean(name)
+	f, err := m.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.locks[name] {
+		return nil, LockedErr
+	}
+	m.locks[name] = true
+	return &memLock{fs: m, name: name}, nil
+}
+
+type memLock struct {
+	fs   *MemFS
+	name string
+	once sync.Once
+}
+
+func (l *memLock) Close() error {
+	l.once.Do(func() {
+		l.fs.mu.Lock()
+		delete(l.fs.locks, l.name)
+		l.fs.mu.Unlock()
+	})
+	return nil
+}
+
+func (m *MemFS) MkdirAll(dirname string, perm os.FileMode) error {
+	dirname = clean(dirname)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for d := dirname; !m.dirs[d]; d = filepath.Dir(d) {
+		if _, ok := m.files[d]; ok {
+			return pathErr("mkdir", d, errors.New("not a directory"))
+		}
+		m.dirs[d] = true
+	}
+	return nil
+}
+
+func (m *MemFS) Stat(name string) (os.FileInfo, error) {
+	name = clean(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if n, ok := m.files[name]; ok {
+		return n.stat(), nil
+	}
+	if m.dirs[name] {
+		return &memFileInfo{name: filepath.Base(name), dir: true}, nil
+	}
+	return nil, pathErr("stat", name, os.ErrNotExist)
+}
+
+func (m *MemFS) SyncDir(dirname string) error {
+	return nil
+}
+
+func (n *memNode) stat() os.FileInfo {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return &memFileInfo{
+		name:    n.name,
+		size:    int64(len(n.data)),
+		modTime: n.modTime,
+	}
+}
+
+type memFile struct {
+	n      *memNode
+	offset int64
+	write  bool
+	closed bool
+}
+
+var closedErr = errors.New("file already closed")
+
+func (f *memFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.closed {
+		return 0, closedErr
+	}
+	f.n.mu.Lock()
+	defer f.n.mu.Unlock()
+	if off >= int64(len(f.n.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.n.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	if f.closed {
+		return 0, closedErr
+	}
+	if !f.write {
+		return 0, errors.New("file opened read only")
+	}
+	f.n.mu.Lock()
+	defer f.n.mu.Unlock()
+	end := f.offset + int64(len(p))
+	if end > int64(len(f.n.data)) {
+		if end > int64(cap(f.n.data)) {
+			data := make([]byte, end, 2*end)
+			copy(data, f.n.data)
+			f.n.data = data
+		}
+		f.n.data = f.n.data[:end]
+	}
+	copy(f.n.data[f.offset:], p)
+	f.offset = end
+	f.n.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		f.n.mu.Lock()
+		offset += int64(len(f.n.data))
+		f.n.mu.Unlock()
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memFile) Close() error {
+	if f.closed {
+		return closedErr
+	}
+	f.closed = true
+	return nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	return f.n.stat(), nil
+}
+
+func (f *memFile) Sync() error {
+	if f.closed {
+		return closedErr
+	}
+	return nil
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (i *memFileInfo) Name() string {
+	return i.name
+}
+
+func (i *memFileInfo) Size() int64 {
+	return i.size
+}
+
+func (i *memFileInfo) Mode() os.FileMode {
+	if i.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (i *memFileInfo) ModTime() time.Time {
+	return i.modTime
+}
+
+func (i *memFileInfo) IsDir() bool {
+	return i.dir
+}
+
+func (i *memFileInfo) Sys() interface{} {
+	return nil
+}
@@ -0,0 +1,95 @@
+package vfs
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestMemFSReadWrite(t *testing.T) {
+	fs := NewMem()
+	assert.Nil(t, fs.MkdirAll("a/b", 0755))
+
+	f, err := fs.Create("a/b/file")
+	assert.Nil(t, err)
+	_, err = f.Write([]byte("hello "))
+	assert.Nil(t, err)
+	_, err = f.Write([]byte("world"))
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	r, err := fs.Open("a/b/file")
+	assert.Nil(t, err)
+	data, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "hello world", string(data))
+
+	buf := make([]byte, 5)
+	n, err := r.ReadAt(buf, 6)
+	assert.Nil(t, err)
+	assert.Equal(t, "world", string(buf[:n]))
+
+	stat, err := r.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(11), stat.Size())
+	assert.Equal(t, "file", stat.Name())
+}
+
+func TestMemFSDirectories(t *testing.T) {
+	fs := NewMem()
+	_, err := fs.Create("missing/file")
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Nil(t, fs.MkdirAll("dir/sub", 0755))
+	for _, name := range []string{"dir/b", "dir/a"} {
+		f, err := fs.Create(name)
+		assert.Nil(t, err)
+		f.Close()
+	}
+	names, err := fs.List("dir")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a", "b", "sub"}, names)
+
+	assert.Nil(t, fs.Rename("dir/a", "dir/sub/c"))
+	names, err = fs.List("dir/sub")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"c"}, names)
+	_, err = fs.Stat("dir/a")
+	assert.True(t, os.IsNotExist(err))
+
+	assert.NotNil(t, fs.Remove("dir/sub"))
+	assert.Nil(t, fs.Remove("dir/sub/c"))
+	assert.Nil(t, fs.Remove("dir/sub"))
+	stat, err := fs.Stat("dir")
+	assert.Nil(t, err)
+	assert.True(t, stat.IsDir())
+}
+
+func TestMemFSLock(t *testing.T) {
+	fs := NewMem()
+	l, err := fs.Lock("LOCK")
+	assert.Nil(t, err)
+	_, err = fs.Lock("LOCK")
+	assert.Equal(t, LockedErr, err)
+	assert.Nil(t, l.Close())
+	l, err = fs.Lock("LOCK")
+	assert.Nil(t, err)
+	l.Close()
+}
+
+func TestMemFSLink(t *testing.T) {
+	fs := NewMem()
+	f, _ := fs.Create("a")
+	f.Write([]byte("shared"))
+	f.Close()
+
+	assert.Nil(t, fs.Link("a", "b"))
+	assert.True(t, os.IsExist(fs.Link("a", "b")))
+	assert.Nil(t, fs.Remove("a"))
+
+	r, err := fs.Open("b")
+	assert.Nil(t, err)
+	data, _ := io.ReadAll(r)
+	assert.Equal(t, "shared", string(data))
+}
@@ -0,0 +1,43 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// LockedErr is returned by Lock when the file is already locked
+var LockedErr = errors.New("file is locked")
+
+// File is an open file. Files returned by Open are read only
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Seeker
+	io.Closer
+	Stat() (os.FileInfo, error)
+	// Sync commits the written contents of the file to stable storage
+	Sync() error
+}
+
+// FS is the filesystem used by the database for all of its files
+type FS interface {
+	// Create creates or truncates the named file for writing
+	Create(name string) (File, error)
+	Open(name string) (File, error)
+	Rename(oldname, newname string) error
+	// Link creates newname as a hard link to oldname
+	Link(oldname, newname string) error
+	// Remove removes a file or an empty directory
+	Remove(name string) error
+	// List returns the names of the entries in dirname
+	List(dirname string) ([]string, error)
+	// Lock takes an exclusive lock on the named file, creating it if needed.
+	// The lock is released by closing the returned Closer
+	Lock(name string) (io.Closer, error)
+	MkdirAll(dirname string, perm os.FileMode) error
+	Stat(name string) (os.FileInfo, error)
+	// SyncDir makes previous creations, renames and removals in dirname durable
+	SyncDir(dirname string) error
+}